@@ -0,0 +1,144 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CacheAside reads values through a Client, computing and storing them
+// on a cache miss. Concurrent misses for the same key share a single
+// computation. Its zero value is usable once Client is set.
+type CacheAside struct {
+	// Client is the memcache client values are read from and stored to.
+	Client *Client
+
+	// RefreshAhead, if non-zero, starts a background recompute of a
+	// value whose remaining TTL has dropped below it, while the current
+	// value is still returned to the caller. At most one recompute per
+	// key runs at a time. Reading the TTL requires the meta protocol.
+	RefreshAhead time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// call is an in-flight or completed compute for a key. done is closed
+// once val and err are set.
+type call struct {
+	done chan struct{}
+	val  []byte
+	err  error
+}
+
+// GetOrSet returns the value for key. On a cache miss, compute is called
+// and its result is stored with the given expiration before being
+// returned. If storing fails, the computed value is returned along with
+// the error. Since the compute is shared by all callers missing the key
+// at once, it is passed a context that carries ctx's values but is never
+// canceled, so that one caller giving up doesn't fail the others; each
+// caller, including the one that started the compute, stops waiting and
+// returns ctx.Err() once its own ctx is done, leaving the compute to
+// finish and store the value. Refresh ahead computes likewise run in the
+// background.
+func (ca *CacheAside) GetOrSet(ctx context.Context, key string, exp int32, compute func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ca.RefreshAhead > 0 {
+		res, err := ca.Client.MetaGet(key, MetaFlags{ReturnValue: true, ReturnTTL: true, ReturnFlags: true})
+		if err == nil {
+			if res.TTL >= 0 && time.Duration(res.TTL)*time.Second < ca.RefreshAhead {
+				ca.refresh(key, exp, compute)
+			}
+			return res.Value, nil
+		}
+		if err != ErrCacheMiss {
+			return nil, err
+		}
+	} else {
+		it, err := ca.Client.Get(key)
+		if err == nil {
+			return it.Value, nil
+		}
+		if !errors.Is(err, ErrCacheMiss) {
+			return nil, err
+		}
+	}
+	cl, started := ca.start(key)
+	if started {
+		go ca.run(detachedContext{ctx}, cl, key, exp, compute)
+	}
+	select {
+	case <-cl.done:
+		return cl.val, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresh recomputes key in the background, unless a compute for it is
+// already in flight.
+func (ca *CacheAside) refresh(key string, exp int32, compute func(ctx context.Context) ([]byte, error)) {
+	if cl, started := ca.start(key); started {
+		go ca.run(context.Background(), cl, key, exp, compute)
+	}
+}
+
+// detachedContext carries the values of a context, but not its deadline
+// or cancelation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)          { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}                { return nil }
+func (detachedContext) Err() error                           { return nil }
+func (dc detachedContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
+
+// start returns the in-flight call for key, registering a new one if
+// there is none. started reports whether the caller must run it.
+func (ca *CacheAside) start(key string) (cl *call, started bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if cl, ok := ca.calls[key]; ok {
+		return cl, false
+	}
+	if ca.calls == nil {
+		ca.calls = make(map[string]*call)
+	}
+	cl = &call{done: make(chan struct{})}
+	ca.calls[key] = cl
+	return cl, true
+}
+
+func (ca *CacheAside) run(ctx context.Context, cl *call, key string, exp int32, compute func(ctx context.Context) ([]byte, error)) {
+	defer func() {
+		ca.mu.Lock()
+		delete(ca.calls, key)
+		ca.mu.Unlock()
+		close(cl.done)
+	}()
+	cl.val, cl.err = compute(ctx)
+	if cl.err != nil {
+		return
+	}
+	cl.err = ca.Client.Set(&Item{Key: key, Value: cl.val, Expiration: exp})
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetOrSet(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	ca := &CacheAside{Client: New(addr)}
+	ca.Client.Timeout = time.Second
+
+	var computed int32
+	compute := func(context.Context) ([]byte, error) {
+		atomic.AddInt32(&computed, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte("value"), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := ca.GetOrSet(context.Background(), "key", 0, compute)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("value"), val)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&computed))
+}
+
+func TestGetOrSetRefreshAhead(t *testing.T) {
+	addr, stored := memoryServer(t, 5)
+	ca := &CacheAside{Client: New(addr), RefreshAhead: time.Minute}
+	ca.Client.Timeout = time.Second
+	assert.NoError(t, ca.Client.Set(&Item{Key: "key", Value: []byte("old")}))
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+	compute := func(context.Context) ([]byte, error) {
+		<-release
+		defer close(done)
+		return []byte("new"), nil
+	}
+	val, err := ca.GetOrSet(context.Background(), "key", 60, compute)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old"), val)
+
+	// a second caller must not start another refresh
+	val, err = ca.GetOrSet(context.Background(), "key", 60, func(context.Context) ([]byte, error) {
+		t.Error("refresh started twice")
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old"), val)
+
+	close(release)
+	<-done
+	for i := 0; i < 100 && stored("key") != "new"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "new", stored("key"))
+}
+
+func TestGetOrSetContext(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	ca := &CacheAside{Client: New(addr)}
+	ca.Client.Timeout = time.Second
+
+	type ctxKey struct{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	leader := make(chan error)
+	leaderCtx, cancelLeader := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "v"))
+	go func() {
+		_, err := ca.GetOrSet(leaderCtx, "key", 0, func(ctx context.Context) ([]byte, error) {
+			assert.Equal(t, "v", ctx.Value(ctxKey{}), "values are passed")
+			close(started)
+			<-release
+			return []byte("computed"), ctx.Err()
+		})
+		leader <- err
+	}()
+	<-started
+
+	// a waiter gives up when its own context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := ca.GetOrSet(ctx, "key", 0, func(context.Context) ([]byte, error) {
+		t.Error("compute started twice")
+		return nil, nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the leader giving up doesn't fail the compute for the others
+	cancelLeader()
+	assert.Equal(t, context.Canceled, <-leader)
+	waiter := make(chan []byte)
+	go func() {
+		val, err := ca.GetOrSet(context.Background(), "key", 0, func(context.Context) ([]byte, error) {
+			t.Error("compute started twice")
+			return nil, nil
+		})
+		assert.NoError(t, err)
+		waiter <- val
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	assert.Equal(t, []byte("computed"), <-waiter)
+}
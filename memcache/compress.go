@@ -0,0 +1,300 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CompressedFlag is the bit of Item.Flags that DefaultFlagLayout
+// reserves to mark values stored compressed. Applications must not use
+// it for their own flags.
+const CompressedFlag uint32 = 1 << 31
+
+// CompressionFlags are the bits of Item.Flags that DefaultFlagLayout
+// uses for compression: CompressedFlag, and the id of the Compressor
+// used to compress a value in the three bits below it. Applications must
+// not use them for their own flags.
+const CompressionFlags uint32 = CompressedFlag | MaxCompressorID<<compressorIDShift
+
+// SchemaVersionFlags are the bits of Item.Flags that DefaultFlagLayout
+// uses for the schema version of a value, see Item.SchemaVersion.
+const SchemaVersionFlags uint32 = 0xff << schemaVersionShift
+
+const schemaVersionShift = 20
+
+// ReservedFlags are the bits of Item.Flags that DefaultFlagLayout
+// reserves for this package's own metadata: CompressionFlags and
+// SchemaVersionFlags. Applications should only use the other bits,
+// through Item.UserFlags and Item.SetUserFlags, or else give their
+// clients another FlagLayout.
+const ReservedFlags uint32 = CompressionFlags | SchemaVersionFlags
+
+const compressorIDShift = 28
+
+// FlagLayout is where in Item.Flags a Client keeps its own metadata:
+// four compression bits, the highest marking compressed values and the
+// three below it holding the id of their Compressor, and eight bits
+// holding the schema version of values. All clients sharing a cache must
+// use the same layout.
+type FlagLayout struct {
+	// CompressionShift is the lowest of the compression bits. It must
+	// be at most 28.
+	CompressionShift uint
+	// SchemaVersionShift is the lowest of the schema version bits. It
+	// must be at most 24, and the bits must not overlap the compression
+	// bits.
+	SchemaVersionShift uint
+}
+
+// DefaultFlagLayout is the FlagLayout of clients that don't set one, with
+// the compression bits at CompressionFlags and the schema version bits
+// at SchemaVersionFlags.
+var DefaultFlagLayout = FlagLayout{
+	CompressionShift:   compressorIDShift,
+	SchemaVersionShift: schemaVersionShift,
+}
+
+// ErrFlagLayout is returned by storage operations of a client whose
+// FlagLayout is invalid.
+var ErrFlagLayout = errors.New("memcache: invalid flag layout")
+
+// validate checks that the bits of l fit in 32 bits and don't overlap
+func (l FlagLayout) validate() error {
+	if l.CompressionShift > 28 || l.SchemaVersionShift > 24 ||
+		l.CompressionFlags()&l.SchemaVersionFlags() != 0 {
+		return ErrFlagLayout
+	}
+	return nil
+}
+
+// CompressedFlag returns the bit of l marking values stored compressed.
+func (l FlagLayout) CompressedFlag() uint32 {
+	return 1 << (l.CompressionShift + 3)
+}
+
+// CompressionFlags returns the compression bits of l.
+func (l FlagLayout) CompressionFlags() uint32 {
+	return 0xf << l.CompressionShift
+}
+
+// SchemaVersionFlags returns the schema version bits of l.
+func (l FlagLayout) SchemaVersionFlags() uint32 {
+	return 0xff << l.SchemaVersionShift
+}
+
+// ReservedFlags returns the compression and schema version bits of l.
+func (l FlagLayout) ReservedFlags() uint32 {
+	return l.CompressionFlags() | l.SchemaVersionFlags()
+}
+
+// UserFlags returns the application's flags of it, without the reserved
+// flags of l.
+func (l FlagLayout) UserFlags(it *Item) uint32 {
+	return it.Flags &^ l.ReservedFlags()
+}
+
+// SetUserFlags sets the application's flags of it to flags, leaving the
+// reserved flags of it as they are. The reserved flags of flags are
+// ignored.
+func (l FlagLayout) SetUserFlags(it *Item, flags uint32) {
+	it.Flags = it.Flags&l.ReservedFlags() | flags&^l.ReservedFlags()
+}
+
+// SchemaVersion returns the schema version of its value per l.
+func (l FlagLayout) SchemaVersion(it *Item) byte {
+	return byte(it.Flags & l.SchemaVersionFlags() >> l.SchemaVersionShift)
+}
+
+// SetSchemaVersion sets the schema version of its value per l, leaving
+// the other flags intact.
+func (l FlagLayout) SetSchemaVersion(it *Item, v byte) {
+	it.Flags = it.Flags&^l.SchemaVersionFlags() | uint32(v)<<l.SchemaVersionShift
+}
+
+// UserFlags returns the application's flags of it, without ReservedFlags.
+// Items of clients with another FlagLayout use its UserFlags instead.
+func (it *Item) UserFlags() uint32 {
+	return DefaultFlagLayout.UserFlags(it)
+}
+
+// SchemaVersion returns the schema version of its value, as set by
+// SetSchemaVersion, for decoders to tell the formats of values apart.
+// It is zero for values stored without one. Items of clients with
+// another FlagLayout use its SchemaVersion instead.
+func (it *Item) SchemaVersion() byte {
+	return DefaultFlagLayout.SchemaVersion(it)
+}
+
+// SetSchemaVersion sets the schema version of its value, which is
+// stored in its SchemaVersionFlags bits, leaving the user flags intact.
+// Items of clients with another FlagLayout use its SetSchemaVersion
+// instead.
+func (it *Item) SetSchemaVersion(v byte) {
+	DefaultFlagLayout.SetSchemaVersion(it, v)
+}
+
+// SetUserFlags sets the application's flags of it to flags, leaving the
+// ReservedFlags bits of it as they are. The ReservedFlags bits of flags
+// are ignored. Items of clients with another FlagLayout use its
+// SetUserFlags instead.
+func (it *Item) SetUserFlags(flags uint32) {
+	DefaultFlagLayout.SetUserFlags(it, flags)
+}
+
+// flagLayout returns the client's FlagLayout, or DefaultFlagLayout
+func (c *Client) flagLayout() FlagLayout {
+	if c.FlagLayout != nil {
+		return *c.FlagLayout
+	}
+	return DefaultFlagLayout
+}
+
+// checkFlags rejects flags using the compression bits of the client's
+// FlagLayout, which would make reads decompress the value, and an
+// invalid FlagLayout
+func (c *Client) checkFlags(flags uint32) error {
+	l := c.flagLayout()
+	if err := l.validate(); err != nil {
+		return err
+	}
+	if flags&l.CompressionFlags() != 0 {
+		return ErrReservedFlags
+	}
+	return nil
+}
+
+// GzipCompressorID is the id of the built-in gzip Compressor, which is
+// used unless another one is registered with this id.
+const GzipCompressorID = 0
+
+// MaxCompressorID is the largest id a Compressor can be registered with.
+const MaxCompressorID = 7
+
+// Compressor is a compression algorithm for values. Implementations must
+// be safe for concurrent use by multiple goroutines.
+type Compressor interface {
+	// Compress returns value compressed.
+	Compress(value []byte) ([]byte, error)
+	// Decompress returns the value that Compress compressed to value.
+	Decompress(value []byte) ([]byte, error)
+}
+
+// gzipCompressor is the built-in Compressor
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(value); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(value []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// compressor returns the Compressor with the given id, or nil
+func (c *Client) compressor(id uint8) Compressor {
+	if comp, ok := c.Compressors[id]; ok {
+		return comp
+	}
+	if id == GzipCompressorID {
+		return gzipCompressor{}
+	}
+	return nil
+}
+
+// compressorFor returns the id of the Compressor item is to be stored
+// with, per CompressionPolicy or else CompressionThreshold, or false if
+// it is to be stored uncompressed.
+func (c *Client) compressorFor(item *Item) (id uint8, ok bool) {
+	if c.CompressionPolicy != nil {
+		return c.CompressionPolicy(item)
+	}
+	if c.CompressionThreshold <= 0 || len(item.Value) < c.CompressionThreshold {
+		return 0, false
+	}
+	return GzipCompressorID, true
+}
+
+// compressValue returns item's value and flags as they are to be stored:
+// compressed, with the compressed flag and the compressor's id set, if
+// compressorFor selects a compressor for item and compressing shrinks
+// the value.
+func (c *Client) compressValue(item *Item) ([]byte, uint32, error) {
+	id, ok := c.compressorFor(item)
+	if !ok {
+		return item.Value, item.Flags, nil
+	}
+	comp := c.compressor(id)
+	if id > MaxCompressorID || comp == nil {
+		return nil, 0, fmt.Errorf("memcache: no compressor with id %d", id)
+	}
+	value, err := comp.Compress(item.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	l := c.flagLayout()
+	flags := item.Flags&^l.CompressionFlags() | l.CompressedFlag() | uint32(id)<<l.CompressionShift
+	if len(value) >= len(item.Value) {
+		value, flags = item.Value, item.Flags
+	}
+	return value, flags, nil
+}
+
+// decompressValue decompresses value, with the compressor whose id is in
+// flags, if flags has the compressed flag of the client's FlagLayout
+// set, returning it along with flags without the compression bits. This
+// is done for every item read regardless of the compression settings,
+// so that values compressed by other clients sharing the cache can be
+// read.
+func (c *Client) decompressValue(key string, value []byte, flags uint32) ([]byte, uint32, error) {
+	l := c.flagLayout()
+	if flags&l.CompressedFlag() == 0 {
+		return value, flags, nil
+	}
+	id := uint8(flags >> l.CompressionShift & MaxCompressorID)
+	comp := c.compressor(id)
+	if comp == nil {
+		return nil, 0, fmt.Errorf("memcache: no compressor with id %d for %q", id, key)
+	}
+	value, err := comp.Decompress(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("memcache: corrupt compressed value for %q: %v", key, err)
+	}
+	return value, flags &^ l.CompressionFlags(), nil
+}
+
+// decompress decompresses it in place, see decompressValue
+func (c *Client) decompress(it *Item) (err error) {
+	it.Value, it.Flags, err = c.decompressValue(it.Key, it.Value, it.Flags)
+	return err
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	addr, stored := memoryServer(t, -1)
+	writer := New(addr)
+	writer.CompressionThreshold = 100
+	big := bytes.Repeat([]byte("compressible "), 100)
+	assert.NoError(t, writer.Set(&Item{Key: "big", Value: big, Flags: 5}))
+	assert.NoError(t, writer.Set(&Item{Key: "small", Value: []byte("tiny"), Flags: 5}))
+	assert.True(t, len(stored("big")) < len(big))
+	assert.Equal(t, "tiny", stored("small"))
+
+	// a reader that doesn't compress still decompresses
+	reader := New(addr)
+	for key, want := range map[string][]byte{"big": big, "small": []byte("tiny")} {
+		it, err := reader.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, want, it.Value)
+		assert.Equal(t, uint32(5), it.Flags)
+	}
+	m, err := reader.GetMulti([]string{"big"})
+	assert.NoError(t, err)
+	assert.Equal(t, big, m["big"].Value)
+
+	res, err := reader.MetaGet("big", MetaFlags{ReturnValue: true, ReturnFlags: true})
+	assert.NoError(t, err)
+	assert.Equal(t, big, res.Value)
+	assert.Equal(t, uint32(5), res.Flags)
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	var c Client
+	_, _, err := c.decompressValue("foo", []byte("not gzip"), CompressedFlag)
+	assert.Error(t, err)
+	value, flags, err := c.decompressValue("foo", []byte("plain"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("plain"), value)
+	assert.Equal(t, uint32(3), flags)
+}
+
+// flateCompressor is a Compressor other than the built-in gzip one
+type flateCompressor struct{}
+
+func (flateCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	if _, err := zw.Write(value); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(value []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(value)))
+}
+
+func TestCompressors(t *testing.T) {
+	addr, stored := memoryServer(t, -1)
+	c := New(addr)
+	c.Compressors = map[uint8]Compressor{1: flateCompressor{}}
+	c.CompressionPolicy = func(item *Item) (uint8, bool) {
+		if strings.HasPrefix(item.Key, "fast:") {
+			return 1, true
+		}
+		return GzipCompressorID, len(item.Value) > 100
+	}
+	big := bytes.Repeat([]byte("compressible "), 100)
+	for _, key := range []string{"fast:big", "big"} {
+		assert.NoError(t, c.Set(&Item{Key: key, Value: big, Flags: 5}))
+		assert.True(t, len(stored(key)) < len(big))
+		it, err := c.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, big, it.Value)
+		assert.Equal(t, uint32(5), it.Flags)
+	}
+
+	// a client without the flate compressor can only read the gzip value
+	other := New(addr)
+	_, err := other.Get("fast:big")
+	assert.Error(t, err)
+	it, err := other.Get("big")
+	assert.NoError(t, err)
+	assert.Equal(t, big, it.Value)
+
+	c.CompressionPolicy = func(*Item) (uint8, bool) { return 2, true }
+	assert.Error(t, c.Set(&Item{Key: "big", Value: big}))
+}
+
+func TestUserFlags(t *testing.T) {
+	it := &Item{Flags: CompressedFlag | 5}
+	assert.Equal(t, uint32(5), it.UserFlags())
+	it.SetUserFlags(0xf1100007)
+	assert.Equal(t, CompressedFlag|7, it.Flags)
+	assert.Equal(t, uint32(7), it.UserFlags())
+
+	// compression keeps the user flags and only touches reserved bits
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	c.CompressionThreshold = 1
+	item := &Item{Key: "big", Value: bytes.Repeat([]byte("compressible "), 100)}
+	item.SetUserFlags(0x000bcdef)
+	assert.NoError(t, c.Set(item))
+	got, err := c.Get("big")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0x000bcdef), got.UserFlags())
+	assert.Equal(t, got.Flags, got.UserFlags())
+}
+
+func TestFlagLayout(t *testing.T) {
+	addr, stored := memoryServer(t, -1)
+	c := New(addr)
+	value := bytes.Repeat([]byte("compressible "), 100)
+	assert.Equal(t, ErrReservedFlags, c.Set(&Item{Key: "foo", Value: value, Flags: CompressedFlag}))
+
+	// an app using the high bits moves the package's bits to the low ones
+	layout := FlagLayout{CompressionShift: 0, SchemaVersionShift: 4}
+	c.FlagLayout = &layout
+	c.CompressionThreshold = 1
+	item := &Item{Key: "foo", Value: value, Flags: 0xfff00000}
+	layout.SetSchemaVersion(item, 3)
+	assert.NoError(t, c.Set(item))
+	assert.True(t, len(stored("foo")) < len(value), "stored compressed")
+	got, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, value, got.Value)
+	assert.Equal(t, uint32(0xfff00000), layout.UserFlags(got))
+	assert.Equal(t, byte(3), layout.SchemaVersion(got))
+	assert.Equal(t, ErrReservedFlags, c.Set(&Item{Key: "foo", Value: value, Flags: 1}))
+
+	c.FlagLayout = &FlagLayout{CompressionShift: 20, SchemaVersionShift: 16}
+	assert.Equal(t, ErrFlagLayout, c.Set(&Item{Key: "foo", Value: value}), "overlapping")
+}
+
+func TestSchemaVersion(t *testing.T) {
+	it := &Item{Flags: 0x000bcdef}
+	assert.Equal(t, byte(0), it.SchemaVersion())
+	it.SetSchemaVersion(0xa5)
+	assert.Equal(t, byte(0xa5), it.SchemaVersion())
+	assert.Equal(t, uint32(0x000bcdef), it.UserFlags())
+
+	// the version survives compression
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	c.CompressionThreshold = 1
+	it.Key = "big"
+	it.Value = bytes.Repeat([]byte("compressible "), 100)
+	assert.NoError(t, c.Set(it))
+	got, err := c.Get("big")
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0xa5), got.SchemaVersion())
+	assert.Equal(t, uint32(0x000bcdef), got.UserFlags())
+	assert.Equal(t, it.Value, got.Value)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// maxRelativeExpiration is MaxRelativeExpiration as a duration
+const maxRelativeExpiration = MaxRelativeExpiration * time.Second
+
+// ParseExpiration parses a Go duration string such as "5m" or "24h" into
+// an Item.Expiration value. Durations of up to 30 days are converted to
+// relative seconds, rounding up so that a short positive duration never
+// becomes zero, which means no expiration. Longer durations are
+// converted to an absolute Unix time, as memcached requires. "0s" means
+// no expiration. Negative durations are rejected.
+func ParseExpiration(s string) (int32, error) {
+	return parseExpiration(s, time.Now())
+}
+
+func parseExpiration(s string, now time.Time) (int32, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("memcache: negative expiration " + s)
+	}
+	if d <= maxRelativeExpiration {
+		return int32((d + time.Second - 1) / time.Second), nil
+	}
+	abs := now.Add(d).Unix()
+	if abs > math.MaxInt32 {
+		return 0, errors.New("memcache: expiration " + s + " is too far in the future")
+	}
+	return int32(abs), nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpiration(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	testCases := []struct {
+		in   string
+		want int32
+		pass bool
+	}{
+		{"0s", 0, true},
+		{"5m", 300, true},
+		{"24h", 86400, true},
+		{"1ms", 1, true},
+		{"1.5s", 2, true},
+		{"720h", 2592000, true},
+		{"721h", 1500000000 + 721*3600, true},
+		{"-1s", 0, false},
+		{"1000000h", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tc := range testCases {
+		got, err := parseExpiration(tc.in, now)
+		if tc.pass {
+			assert.NoError(t, err, tc.in)
+			assert.Equal(t, tc.want, got, tc.in)
+		} else {
+			assert.Error(t, err, tc.in)
+		}
+	}
+}
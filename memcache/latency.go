@@ -0,0 +1,153 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultProbeInterval is the default interval between the latency
+// probes of a LatencyAwareSelector.
+const DefaultProbeInterval = 10 * time.Second
+
+// LatencyAwareSelector is a ReplicaSelector that orders the replicas of
+// each key by the latency of their servers, as periodically measured by
+// Client.LatencyProbe, so that reads of replicated keys prefer fast
+// servers and route around degraded ones. PickServer is passed through
+// unchanged, keeping the placement of keys with a single owner stable.
+type LatencyAwareSelector struct {
+	ReplicaSelector
+
+	// ProbeInterval is the time between latency probes. If zero,
+	// DefaultProbeInterval is used.
+	ProbeInterval time.Duration
+
+	// Penalty, if non-nil, maps a server's measured round trip time to
+	// the cost replicas are ordered by, e.g. to only penalize servers
+	// much slower than the others. Servers that couldn't be probed are
+	// measured as Unreachable. If nil, replicas are ordered by their
+	// round trip time.
+	Penalty func(rtt time.Duration) time.Duration
+
+	mu    sync.RWMutex
+	costs map[string]time.Duration
+	stop  chan struct{}
+}
+
+// NewLatencyAwareSelector returns a LatencyAwareSelector ordering the
+// replicas of rs. Probing starts once Start is called.
+func NewLatencyAwareSelector(rs ReplicaSelector) *LatencyAwareSelector {
+	return &LatencyAwareSelector{ReplicaSelector: rs}
+}
+
+// Start probes the latency of c's servers right away and then every
+// ProbeInterval until Stop is called. c is normally the client using the
+// selector. Calling Start again stops the earlier probing first.
+func (ls *LatencyAwareSelector) Start(c *Client) {
+	interval := ls.ProbeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	stop := make(chan struct{})
+	ls.mu.Lock()
+	if ls.stop != nil {
+		close(ls.stop)
+	}
+	ls.stop = stop
+	ls.mu.Unlock()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			// failed servers are included as Unreachable
+			latencies, _ := c.LatencyProbe()
+			ls.Observe(latencies)
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the probing begun by Start.
+func (ls *LatencyAwareSelector) Stop() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.stop != nil {
+		close(ls.stop)
+		ls.stop = nil
+	}
+}
+
+// Observe records measured server latencies, replacing earlier ones. It
+// is called by the probes begun by Start, but may also be fed from
+// other measurements.
+func (ls *LatencyAwareSelector) Observe(latencies map[net.Addr]time.Duration) {
+	costs := make(map[string]time.Duration, len(latencies))
+	for addr, rtt := range latencies {
+		if ls.Penalty != nil {
+			rtt = ls.Penalty(rtt)
+		}
+		costs[addr.String()] = rtt
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.costs = costs
+}
+
+// IsBinary reports whether the wrapped selector, if it is a
+// ProtocolSelector, marks addr as speaking the binary protocol, so that
+// wrapping it keeps its per-server protocols.
+func (ls *LatencyAwareSelector) IsBinary(addr net.Addr) bool {
+	ps, ok := ls.ReplicaSelector.(ProtocolSelector)
+	return ok && ps.IsBinary(addr)
+}
+
+// selectionVersion is that of the wrapped selector, as PickServer is
+// passed through
+func (ls *LatencyAwareSelector) selectionVersion() (uint64, bool) {
+	vs, ok := ls.ReplicaSelector.(versionedSelector)
+	if !ok {
+		return 0, false
+	}
+	return vs.selectionVersion()
+}
+
+// PickReplicas returns the replicas of key ordered by cost, fastest
+// first. Servers without a measurement yet sort first, so that new
+// servers are tried; servers of equal cost keep their order.
+func (ls *LatencyAwareSelector) PickReplicas(key string) ([]net.Addr, error) {
+	addrs, err := ls.ReplicaSelector.PickReplicas(key)
+	if err != nil {
+		return nil, err
+	}
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	if len(ls.costs) == 0 {
+		return addrs, nil
+	}
+	addrs = append([]net.Addr(nil), addrs...)
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return ls.costs[addrs[i].String()] < ls.costs[addrs[j].String()]
+	})
+	return addrs, nil
+}
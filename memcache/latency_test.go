@@ -0,0 +1,136 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyAwareSelectorOrder(t *testing.T) {
+	var rl ReplicaList
+	assert.NoError(t, rl.SetServers("127.0.0.1:1234", "127.0.0.1:1235", "127.0.0.1:1236"))
+	rl.SetReplicas(3)
+	ls := NewLatencyAwareSelector(&rl)
+	want, err := rl.PickReplicas("foo")
+	assert.NoError(t, err)
+	got, err := ls.PickReplicas("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	ls.Observe(map[net.Addr]time.Duration{
+		want[0]: Unreachable,
+		want[1]: 5 * time.Millisecond,
+		want[2]: time.Millisecond,
+	})
+	got, err = ls.PickReplicas("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.Addr{want[2], want[1], want[0]}, got)
+	// placement of single owner keys is unaffected
+	first, err := ls.PickServer("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, want[0], first)
+
+	// a penalty that only singles out unreachable servers keeps the order
+	ls.Penalty = func(rtt time.Duration) time.Duration {
+		if rtt == Unreachable {
+			return rtt
+		}
+		return 0
+	}
+	ls.Observe(map[net.Addr]time.Duration{want[0]: time.Second, want[1]: Unreachable, want[2]: time.Millisecond})
+	got, err = ls.PickReplicas("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.Addr{want[0], want[2], want[1]}, got)
+}
+
+func TestLatencyAwareSelectorProtocol(t *testing.T) {
+	var rl ReplicaList
+	assert.NoError(t, rl.SetServers("127.0.0.1:1234", "127.0.0.1:1235"))
+	assert.NoError(t, rl.SetBinaryServers("127.0.0.1:1235"))
+	var ps ProtocolSelector = NewLatencyAwareSelector(&rl)
+	text, _ := resolveAddr("127.0.0.1:1234")
+	bin, _ := resolveAddr("127.0.0.1:1235")
+	assert.False(t, ps.IsBinary(text))
+	assert.True(t, ps.IsBinary(bin))
+}
+
+func TestLatencyAwareSelectorRestart(t *testing.T) {
+	var mu sync.Mutex
+	probes := 0
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		mu.Lock()
+		probes++
+		mu.Unlock()
+		fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+	})
+	var rl ReplicaList
+	assert.NoError(t, rl.SetServers(addr))
+	ls := NewLatencyAwareSelector(&rl)
+	ls.ProbeInterval = time.Millisecond
+	c := NewFromSelector(ls)
+	ls.Start(c)
+	ls.Start(c)
+	time.Sleep(20 * time.Millisecond)
+	ls.Stop()
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	stopped := probes
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, stopped, probes, "no probes after Stop")
+}
+
+func TestLatencyAwareSelectorProbe(t *testing.T) {
+	server := func(delay time.Duration) string {
+		return fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+			time.Sleep(delay)
+			fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+		})
+	}
+	slow, fast := server(30*time.Millisecond), server(0)
+	var rl ReplicaList
+	assert.NoError(t, rl.SetServers(slow, fast))
+	rl.SetReplicas(2)
+	ls := NewLatencyAwareSelector(&rl)
+	ls.ProbeInterval = 10 * time.Millisecond
+	c := NewFromSelector(ls)
+	c.Timeout = time.Second
+	ls.Start(c)
+	defer ls.Stop()
+
+	key := keyFor(t, &rl, slow)
+	var got []net.Addr
+	for i := 0; i < 100; i++ {
+		var err error
+		got, err = ls.PickReplicas(key)
+		assert.NoError(t, err)
+		if got[0].String() == fast {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, fast, got[0].String())
+}
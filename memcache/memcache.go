@@ -20,12 +20,17 @@ package memcache
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
 
 	"encoding/binary"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -44,6 +49,10 @@ const (
 	opSet     = byte(0x01)
 	opAdd     = byte(0x02)
 	opReplace = byte(0x03)
+	opDelete  = byte(0x04)
+	opNoop    = byte(0x0a)
+	opGetK    = byte(0x0c)
+	opGetKQ   = byte(0x0d)
 
 	// statuses
 	statusSuccess        = uint16(0x00)
@@ -93,6 +102,15 @@ var (
 	// CompareAndSwap) failed because the condition was not satisfied.
 	ErrNotStored = errors.New("memcache: item not stored")
 
+	// ErrNoCasID means that CompareAndSwap, or another operation
+	// guarded by a CAS ID, was given a CAS ID that is unset.
+	ErrNoCasID = errors.New("memcache: item has no CasID")
+
+	// ErrExpirationTooLarge means that an expiration over
+	// MaxRelativeExpiration was given to a Client whose ExpirationPolicy
+	// is ExpirationRelativeSeconds.
+	ErrExpirationTooLarge = errors.New("memcache: expiration over 30 days")
+
 	// ErrServerError means that a server error occurred.
 	ErrServerError = errors.New("memcache: server error")
 
@@ -107,6 +125,11 @@ var (
 	// ErrNoServers is returned when no servers are configured or available.
 	ErrNoServers = errors.New("memcache: no servers configured or available")
 
+	// ErrDuplicateServer is returned by ServerList.SetServers when a
+	// server is listed more than once and its DuplicatePolicy is
+	// DuplicatesReject.
+	ErrDuplicateServer = errors.New("memcache: duplicate server")
+
 	// ErrWrongMagic is returned if the server returns the incorrect magic
 	ErrWrongMagic = errors.New("memcache: wrong magic")
 
@@ -125,6 +148,45 @@ var (
 	// ErrValuePresent is returned if value is present when it should't be
 	ErrValuePresent = errors.New("memcache: value present")
 
+	// ErrUnknownCommand is wrapped in a ProtocolError when the server
+	// replies ERROR, meaning it doesn't know the command sent, e.g.
+	// because it predates it. The connection is closed since its framing
+	// can no longer be trusted.
+	ErrUnknownCommand = errors.New("memcache: server doesn't know the command")
+
+	// ErrProtocol means that a response was mis-framed, such as a value
+	// that isn't followed by "\r\n" after its announced length. The
+	// connection is closed, since later responses on it would be read
+	// out of sync.
+	ErrProtocol = errors.New("memcache: response framing error")
+
+	// ErrPartialResult is returned by GetMultiContext when the context is
+	// done before all servers have responded.
+	ErrPartialResult = errors.New("memcache: partial result")
+
+	// ErrPoolTimeout is returned when no connection to a server became
+	// available within AcquirePoolTimeout because MaxOpenConns
+	// connections to it were already in use.
+	ErrPoolTimeout = errors.New("memcache: timed out waiting for a free connection")
+
+	// ErrValueTooLarge is returned when an item's value, as it would be
+	// stored, is over the client's MaxValueSize or the limit found by
+	// AutoDetectLimits.
+	ErrValueTooLarge = errors.New("memcache: value too large")
+
+	// ErrResponseTooLarge is returned by GetMulti and the other
+	// multi-gets when the values read would add up to more than the
+	// client's MaxMultiGetBytes.
+	ErrResponseTooLarge = errors.New("memcache: response too large")
+
+	// ErrReservedFlags is returned when an item to be stored has flags
+	// using the compression bits of the client's FlagLayout, which
+	// only the client may set.
+	ErrReservedFlags = errors.New("memcache: item flags use reserved compression bits")
+
+	// ErrClientClosed is returned by operations started after Close.
+	ErrClientClosed = errors.New("memcache: client is closed")
+
 	// ErrUnsupported is returned if a method is called with a binary client that hasn't been implemented yet
 	ErrUnsupported = errors.New("memcache: the binary version of this method hasn't been implemented yet")
 )
@@ -144,36 +206,122 @@ const (
 	// DefaultMaxIdleConns is the default maximum number of idle connections
 	// kept for any single address.
 	DefaultMaxIdleConns = 2
+
+	// DefaultMaxKeysPerRequest is the default maximum number of keys
+	// sent in a single text protocol "gets" command.
+	DefaultMaxKeysPerRequest = 100
+
+	// DefaultReadBufferSize is the default size of each connection's read
+	// buffer.
+	DefaultReadBufferSize = 4096
+
+	// DefaultBinaryBatchSize is the default number of keys pipelined per
+	// batch by GetMulti in binary mode.
+	DefaultBinaryBatchSize = 100
+
+	// DefaultServerRetryInterval is the default time a server that
+	// failed to be dialed is considered down by FailFastWhenNoServers.
+	DefaultServerRetryInterval = time.Second
 )
 
 type doer func(*conn, *Item) (*Item, error)
 
 const buffered = 8 // arbitrary buffered channel size, for readability
 
+const fanOutLimit = 16 // max concurrent servers contacted by fleet-wide ops
+
+// ServerErrors is the error returned by operations that contact every
+// server, such as DeleteAll, when some of the servers fail. It maps each
+// failed server to its error.
+type ServerErrors map[net.Addr]error
+
+func (se ServerErrors) Error() string {
+	msgs := make([]string, 0, len(se))
+	for addr, err := range se {
+		msgs = append(msgs, addr.String()+": "+err.Error())
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("memcache: %d server(s) failed: %s", len(se), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the servers' errors, ordered by server address, so that
+// errors.Is and errors.As see them.
+func (se ServerErrors) Unwrap() []error {
+	addrs := make([]net.Addr, 0, len(se))
+	for addr := range se {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+	errs := make([]error, len(addrs))
+	for i, addr := range addrs {
+		errs[i] = se[addr]
+	}
+	return errs
+}
+
 // resumableError returns true if err is only a protocol-level cache error.
 // This is used to determine whether or not a server connection should
 // be re-used or not. If an error occurs, by default we don't reuse the
 // connection, unless it was just a cache error.
 func resumableError(err error) bool {
 	switch err {
-	case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey:
+	case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey, ErrNoCasID, ErrValueTooLarge:
 		return true
 	}
-	return false
+	return errors.Is(err, ErrMalformedKey)
+}
+
+// resumableError is like the package level resumableError, but only
+// treats a cache miss as resumable if CloseOnError is set.
+func (c *Client) resumableError(err error) bool {
+	if c.CloseOnError {
+		return err == ErrCacheMiss
+	}
+	return resumableError(err)
+}
+
+// unexpectedResponse returns the error for a response line that isn't a
+// valid reply to verb. A bare ERROR means that the server doesn't know
+// the command.
+func unexpectedResponse(verb string, line []byte) error {
+	if bytes.Equal(line, resultError) {
+		return &ProtocolError{Verb: verb, Err: ErrUnknownCommand}
+	}
+	return fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
+}
+
+// accessKey calls OnKeyAccess, if set, for key
+func (c *Client) accessKey(op, key string) {
+	if c.OnKeyAccess != nil {
+		c.OnKeyAccess(op, key)
+	}
+}
+
+// accessKeys calls OnKeyAccess, if set, for every key of keys
+func (c *Client) accessKeys(op string, keys []string) {
+	if c.OnKeyAccess != nil {
+		for _, key := range keys {
+			c.OnKeyAccess(op, key)
+		}
+	}
 }
 
-func (c *Client) legalKey(key string) bool {
+// ValidateKey returns nil if key can be used with this client, or else an
+// error wrapping ErrMalformedKey that tells why: that it is longer than
+// 250 bytes, or, for the text protocol, the offending whitespace or
+// control byte and its position.
+func (c *Client) ValidateKey(key string) error {
 	if len(key) > 250 {
-		return false
+		return fmt.Errorf("%w: %d bytes long, more than 250", ErrMalformedKey, len(key))
 	}
 	if !c.Binary {
 		for i := 0; i < len(key); i++ {
 			if key[i] <= ' ' || key[i] == 0x7f {
-				return false
+				return fmt.Errorf("%w: illegal byte %#02x at position %d", ErrMalformedKey, key[i], i)
 			}
 		}
 	}
-	return true
+	return nil
 }
 
 var (
@@ -188,8 +336,10 @@ var (
 	resultEnd       = []byte("END\r\n")
 	resultOk        = []byte("OK\r\n")
 	resultTouched   = []byte("TOUCHED\r\n")
+	resultError     = []byte("ERROR\r\n")
 
 	resultClientErrorPrefix = []byte("CLIENT_ERROR ")
+	resultVersionPrefix     = []byte("VERSION ")
 )
 
 // New returns a memcache client using the provided server(s)
@@ -206,7 +356,34 @@ func New(server ...string) *Client {
 
 // NewFromSelector returns a new Client using the provided ServerSelector.
 func NewFromSelector(ss ServerSelector) *Client {
-	return &Client{selector: ss}
+	return &Client{selector: ss, pool: new(pool)}
+}
+
+// NewFromConnFunc returns a new Client that gets its connections by
+// calling connect rather than by dialing servers, for transports such as
+// in-memory pipes in tests, tunnels, or connections set up by the
+// caller. All keys are sent over connect's connections, which are
+// pooled as usual. They are used as connect returns them: no server
+// address is dialed, and Dialer, TLSConfig, TLSServerName,
+// SendBufferSize and RecvBufferSize are ignored, so connect must set up
+// TLS itself if it is wanted.
+func NewFromConnFunc(connect func() (net.Conn, error)) *Client {
+	se := &SingleEndpoint{addr: &staticAddr{ntw: "func", str: "func"}}
+	c := NewFromSelector(se)
+	c.connect = connect
+	return c
+}
+
+// Clone returns a copy of the client whose settings, such as Timeout or
+// NegativeCacheTTL, can be changed independently of c's, but which
+// shares c's servers, connection pool and other per-server state. This
+// lets clients configured differently, say one per tenant, use the same
+// connections. A pooled connection follows the settings of the client
+// currently using it, and Reset or Close on any of the clients affect
+// them all.
+func (c *Client) Clone() *Client {
+	c2 := *c
+	return &c2
 }
 
 // Client is a memcache client.
@@ -215,7 +392,8 @@ type Client struct {
 	// Timeout specifies the socket read/write timeout.
 	// If zero, DefaultTimeout is used.
 	Timeout time.Duration
-	// determines which protocol is used, binary or plaintext
+	// determines which protocol is used, binary or plaintext. If false,
+	// a ProtocolSelector may still mark some servers as binary.
 	Binary bool
 
 	// MaxIdleConns specifies the maximum number of idle connections that will
@@ -226,10 +404,350 @@ type Client struct {
 	// be set to a number higher than your peak parallel requests.
 	MaxIdleConns int
 
+	// MaxIdleConnsFor, if non-nil, returns the maximum number of idle
+	// connections maintained for addr, overriding MaxIdleConns, so that
+	// bigger servers of a heterogeneous fleet, e.g. the ones weighted up
+	// in the server list, can be given more. If it returns less than
+	// one, MaxIdleConns is used. It is called with the client's pool
+	// locked, so it must be fast and must not use the client.
+	MaxIdleConnsFor func(addr net.Addr) int
+
+	// ValidateIdleAfter, if positive, makes operations ping a pooled
+	// connection idle for longer than this before using it, with a
+	// "version" command or a binary no-op, discarding it for another
+	// one, or a new one, if the ping fails. This trades a round trip
+	// for not failing on connections that servers or middleboxes closed
+	// while they were idle.
+	ValidateIdleAfter time.Duration
+
+	// MaxRetries is the number of times an operation on a single
+	// server, including each server's part of GetMulti, is retried
+	// right away, on another connection, after failing with an error
+	// accepted by RetryIf. If zero, operations aren't retried. Note that
+	// a retried GetMultiFunc may pass an item to its function again.
+	MaxRetries int
+
+	// RetryIf, if non-nil, decides which errors are retried per
+	// MaxRetries, e.g. to also retry the io.EOF of a connection that the
+	// server dropped. If nil, DefaultRetryIf is used, which only accepts
+	// connection-level errors, so that errors such as ErrCacheMiss and
+	// ErrNotStored are never retried.
+	RetryIf func(err error) bool
+
+	// DisablePooling, if true, closes each connection once its operation
+	// completes instead of keeping it idle for reuse, so that every
+	// operation dials a new connection. This costs a connection setup,
+	// and with it at least one round trip, per operation, but suits
+	// one-shot tools and proxies that expect short-lived connections.
+	DisablePooling bool
+
+	// MaxOpenConns limits the number of connections to each server that
+	// are in use at once; idle connections don't count against it. When
+	// the limit is reached, operations wait for a connection to be
+	// released, for at most AcquirePoolTimeout. If less than one, there
+	// is no limit.
+	MaxOpenConns int
+
+	// AcquirePoolTimeout is the maximum time an operation waits for a
+	// connection when MaxOpenConns is reached, after which it fails with
+	// ErrPoolTimeout. This bounds the wait separately from Timeout, which
+	// only applies to I/O. If zero, operations wait until a connection is
+	// released or, for methods taking a context, until it is done.
+	AcquirePoolTimeout time.Duration
+
+	// FlagLayout, if non-nil, moves the bits of Item.Flags this package
+	// keeps its metadata in away from those of DefaultFlagLayout, for
+	// applications already using those for their own flags. All clients
+	// sharing a cache must use the same layout.
+	FlagLayout *FlagLayout
+
+	// CompressionThreshold, if positive, gzip compresses values of at
+	// least this many bytes before storing them, marking them with the
+	// compressed flag of FlagLayout, CompressedFlag by default. Values
+	// are only stored compressed if that makes them smaller. Compressed
+	// values are decompressed on read whatever the threshold, including
+	// those stored by other clients.
+	CompressionThreshold int
+
+	// Compressors registers compression algorithms by id, from 0 to
+	// MaxCompressorID, in addition to the built-in gzip one with id
+	// GzipCompressorID. The id of the algorithm a value was compressed
+	// with is stored in its flags, so that reads decompress it with the
+	// same one; clients sharing a cache must register the same ids.
+	Compressors map[uint8]Compressor
+
+	// CompressionPolicy, if non-nil, chooses the id of the compressor of
+	// each item stored, such as one for large values and a faster one
+	// for latency-sensitive keys, or returns false to store it
+	// uncompressed. It replaces CompressionThreshold.
+	CompressionPolicy func(item *Item) (id uint8, compress bool)
+
+	// FailFastWhenNoServers, if true, makes operations return
+	// ErrNoServers right away, without dialing, while every server is
+	// down. A server is considered down for ServerRetryInterval after a
+	// dial to it fails, and up again as soon as a dial succeeds. This
+	// avoids operations piling up on dial timeouts during a total
+	// outage; once the interval has passed, operations try dialing again.
+	FailFastWhenNoServers bool
+
+	// ServerRetryInterval is how long a server is considered down after
+	// a failed dial. If zero, DefaultServerRetryInterval is used.
+	ServerRetryInterval time.Duration
+
+	// ExpirationPolicy is how expirations given to Set, Add, Replace,
+	// CompareAndSwap, SetMulti, SetMeta and Touch are checked. The zero
+	// value is ExpirationRaw, which passes them through.
+	ExpirationPolicy ExpirationPolicy
+
+	// ValidateValue, if non-nil, is called with the value of every item
+	// given to Set, Add, Replace, CompareAndSwap, SetMulti and SetMeta
+	// before anything is sent. If it returns an error, the operation
+	// is aborted and returns that error; for SetMulti, no items are
+	// stored. It can be used to enforce policies such as a maximum size
+	// or valid UTF-8 in one place.
+	ValidateValue func(value []byte) error
+
+	// MaxValueSize, if positive, is the size in bytes over which values,
+	// as they would be stored after compression, are rejected with
+	// ErrValueTooLarge before a connection is used, to match the
+	// server's item size limit (1MB by default, set with -I). Since that
+	// limit also covers the key and per-item overhead, values just under
+	// it may still be rejected by the server. SetMulti skips the items
+	// over it, stores the others and returns ErrValueTooLarge.
+	MaxValueSize int
+
+	// AutoDetectLimits, if true, reads the "item_size_max" setting of
+	// each text protocol server on the first connection to it, with a
+	// "stats settings" command, and uses it in place of MaxValueSize for
+	// the values bound for that server. Servers that don't report it
+	// use MaxValueSize.
+	AutoDetectLimits bool
+
+	// MaxMultiGetBytes, if positive, caps the total size in bytes of the
+	// values GetMulti, GetMultiStrict, GetMultiContext and
+	// SelectionCache.GetMulti read. Each value's size, as the server
+	// declares it, is counted before the value is read, and once the
+	// values would add up to more, the value isn't read, the connections
+	// whose responses are still being read are closed, and
+	// ErrResponseTooLarge is returned without items, so that a
+	// pathological batch can't exhaust memory.
+	MaxMultiGetBytes int
+
+	// ReplicatedKey, if non-nil, reports whether key is replicated to
+	// several servers. It only has an effect if the selector is a
+	// ReplicaSelector. Get reads a replicated key from all of its
+	// replicas at once and returns the first hit, while Set, Add,
+	// Replace and Delete are sent to every replica. Other operations
+	// only use the key's first replica.
+	ReplicatedKey func(key string) bool
+
+	// ReplicaReads is the number of replicas Get reads a replicated key
+	// from at once, in the selector's order of preference. The next ones
+	// are only read if those all miss or fail. If less than one, all
+	// replicas are read at once.
+	ReplicaReads int
+
+	// Dialer, if non-nil, is used to dial all connections, for example to
+	// bind them to a local address with LocalAddr or to set a Control
+	// function. Its Timeout is overridden by the client's Timeout. If
+	// nil, a zero net.Dialer is used.
+	Dialer *net.Dialer
+
+	// TLSConfig, if non-nil, makes all connections use TLS with this
+	// configuration, such as for managed caches that require it.
+	TLSConfig *tls.Config
+
+	// TLSServerName, if non-nil, returns the name to verify the
+	// certificate of the server at addr against, and to send with SNI,
+	// overriding TLSConfig.ServerName. This is needed when servers
+	// present certificates for a name other than their address, e.g.
+	// behind a load balancer. If both are unset, each server is
+	// verified against the host name it was configured with, e.g.
+	// "cache.example.com" for "cache.example.com:11211", rather than
+	// the IP address the name resolved to.
+	TLSServerName func(addr net.Addr) string
+
+	// SendBufferSize and RecvBufferSize set the size of the operating
+	// system's send and receive buffers for each connection, which can
+	// help throughput of large items over high latency links. Zero leaves
+	// the OS defaults. They only apply to TCP connections and are ignored
+	// for unix sockets.
+	SendBufferSize int
+	RecvBufferSize int
+
+	// MaxKeysPerRequest is the maximum number of keys sent to a server in
+	// a single text protocol "gets" command by GetMulti, which avoids
+	// exceeding the server's maximum command line length. Larger key sets
+	// are split into several commands on the same connection. If less
+	// than one, DefaultMaxKeysPerRequest is used.
+	MaxKeysPerRequest int
+
+	// ReadBufferSize is the size of each connection's read buffer. A
+	// larger buffer lets big responses, such as those of multi-gets, be read
+	// in fewer syscalls. If less than one, DefaultReadBufferSize is used.
+	ReadBufferSize int
+
+	// BinaryBatchSize is the number of keys GetMulti pipelines in binary
+	// mode before waiting for their responses. If less than one,
+	// DefaultBinaryBatchSize is used.
+	BinaryBatchSize int
+
+	// LenientLineEndings, if true, accepts response lines, and the ends
+	// of values, terminated by a bare "\n" rather than "\r\n", for
+	// memcached-compatible servers and proxies that are lenient about
+	// line endings. By default, responses must follow the protocol
+	// strictly.
+	LenientLineEndings bool
+
+	// CloseOnError, if true, closes a connection rather than returning it
+	// to the pool after any error other than ErrCacheMiss, including
+	// protocol-level errors such as ErrNotStored that normally leave the
+	// connection usable. This rules out reuse of a connection whose
+	// framing might be out of sync, at the cost of a new dial after every
+	// such error.
+	CloseOnError bool
+
+	// NoReplySyncInterval is the number of noreply commands, such as
+	// those of DeleteNoReply, sent on a connection before waiting for
+	// the server to have processed them, which surfaces their errors. If
+	// less than one, DefaultNoReplySyncInterval is used.
+	NoReplySyncInterval int
+
+	// OnKeyAccess, if non-nil, is called with the operation, such as
+	// "get", "set" or "mg", and the key accessed, once for every key of
+	// every operation, including each key of GetMulti, before the
+	// operation is sent. It is meant for audit logging and access pattern
+	// analysis, unlike aggregated metrics. It must be safe for concurrent
+	// use and should be fast, since it runs inline.
+	OnKeyAccess func(op, key string)
+
+	// GetMultiOnError is how GetMulti and GetMultiFunc handle servers
+	// that fail. The zero value is GetMultiPartial.
+	GetMultiOnError GetMultiErrorPolicy
+
+	// OnGetMultiSkip, if non-nil, is called with a server that failed,
+	// its keys and its error when GetMultiOnError is GetMultiSkip, to
+	// report which keys were skipped. It may be called concurrently.
+	OnGetMultiSkip func(addr net.Addr, keys []string, err error)
+
+	// OnUnavailable, if non-nil, is consulted by Get, with op "get",
+	// when it fails because its server is unavailable: it can't be
+	// dialed, or no server is up per FailFastWhenNoServers. If it
+	// returns true, Get returns an item with the returned value as a
+	// hit instead of the error. This turns cache outages into degraded
+	// service in one place, e.g. by falling back to an in-process cache
+	// or a default. It may be called concurrently.
+	OnUnavailable func(op, key string) (value []byte, ok bool)
+
+	// NegativeCacheTTL, if positive, makes Get remember keys that missed
+	// for this long, during which Get returns ErrCacheMiss for them
+	// without a round trip. This relieves the servers of keys that are
+	// requested often but absent. Storing a key through this client,
+	// with Set, Add, Replace, CompareAndSwap, SetMulti or SetMeta,
+	// forgets its miss; but keys stored by other clients may be reported
+	// missing for up to NegativeCacheTTL.
+	NegativeCacheTTL time.Duration
+
+	// NegativeCacheSize is the maximum number of missed keys remembered
+	// for NegativeCacheTTL, beyond which the least recently missed are
+	// forgotten. If less than one, DefaultNegativeCacheSize is used.
+	NegativeCacheSize int
+
+	// WrapMissWithKey, if true, makes Get return its cache misses as a
+	// *CacheMissError naming the key, which still matches ErrCacheMiss
+	// with errors.Is, so that concurrent misses can be told apart in
+	// logs. It is off by default to spare the allocation; compare Get's
+	// errors with errors.Is when it is set.
+	WrapMissWithKey bool
+
 	selector ServerSelector
 
-	lk       sync.Mutex
-	freeconn map[string][]*conn
+	// connect, if non-nil, replaces dialing, per NewFromConnFunc
+	connect func() (net.Conn, error)
+
+	// now returns the current time, used for all time-based logic such
+	// as I/O deadlines. If nil, time.Now is used; tests can replace it
+	// with a fake clock.
+	now func() time.Time
+
+	// pool is shared with the client's clones
+	*pool
+}
+
+// pool holds the connections and per-server state of a Client, which
+// are shared by all of its clones.
+type pool struct {
+	lk        sync.Mutex
+	freeconn  map[string][]*conn
+	slots     map[string]chan struct{}
+	poolStats PoolStats
+
+	// gen is incremented by Reset; connections dialed before then
+	// aren't pooled again.
+	gen uint64
+
+	// down maps servers that failed to be dialed to when they may be
+	// retried
+	down map[string]time.Time
+
+	// evictions are the snapshots EvictionPressure last computed rates
+	// from
+	evictions map[string]evictionSnapshot
+
+	// misses are the keys remembered per NegativeCacheTTL
+	misses negativeCache
+
+	// inUse are the connections taken from the pool or dialed, and not
+	// yet released, which Close closes along with the idle ones
+	inUse map[*conn]struct{}
+
+	// closed is set by Close
+	closed bool
+
+	// itemSizeMax maps the servers probed for AutoDetectLimits to their
+	// item_size_max, or 0 if they don't report it
+	itemSizeMax map[string]int
+}
+
+// PoolStats are counters of waits for a connection caused by
+// MaxOpenConns, and of the idle connections of each server.
+type PoolStats struct {
+	// Waits is the number of times an operation had to wait for a
+	// connection.
+	Waits uint64
+
+	// Timeouts is the number of waits that failed with ErrPoolTimeout.
+	Timeouts uint64
+
+	// WaitDuration is the total time spent waiting for connections.
+	WaitDuration time.Duration
+
+	// Idle are the idle connection counters of each server, by address.
+	Idle map[string]IdleStats
+}
+
+// IdleStats are counters of a server's idle connections, e.g. to tune
+// MaxIdleConns.
+type IdleStats struct {
+	// MaxIdleSeen is the largest number of idle connections the server
+	// has had at once.
+	MaxIdleSeen int
+
+	// IdleEvictions is the number of connections closed rather than
+	// kept idle because the server already had MaxIdleConns idle ones.
+	IdleEvictions uint64
+}
+
+// PoolStats returns the client's connection pool counters.
+func (c *Client) PoolStats() PoolStats {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	stats := c.poolStats
+	stats.Idle = make(map[string]IdleStats, len(c.poolStats.Idle))
+	for addr, idle := range c.poolStats.Idle {
+		stats.Idle[addr] = idle
+	}
+	return stats
 }
 
 // TODO implement the rest as we add ops
@@ -241,7 +759,7 @@ func (i *Item) validateResponse(op byte) error {
 		fallthrough
 	case opReplace:
 		// MUST have CAS
-		if i.casid == uint64(0) {
+		if i.CasID == uint64(0) {
 			return ErrMissingCas
 		}
 		// MUST not have extras
@@ -265,11 +783,20 @@ type Item struct {
 	// Key is the Item's key (250 bytes maximum).
 	Key string
 
-	// Value is the Item's value.
+	// Value is the Item's value. The Value of an Item returned by this
+	// package is always a fresh slice owned by the caller; it never
+	// aliases a connection's buffers, so it stays valid and may be
+	// modified after later operations. An empty Value is stored and
+	// read back as such, with either protocol, making the key present
+	// rather than a miss.
 	Value []byte
 
 	// Flags are server-opaque flags whose semantics are entirely
-	// up to the app.
+	// up to the app, except for the ReservedFlags bits, or those of
+	// the client's FlagLayout, which this package uses for metadata
+	// such as compression. UserFlags and SetUserFlags only deal with
+	// the other bits. Items with compression bits set are rejected
+	// with ErrReservedFlags when stored.
 	Flags uint32
 
 	// Expiration is the cache expiration time, in seconds: either a relative
@@ -277,8 +804,11 @@ type Item struct {
 	// Zero means the Item has no expiration time.
 	Expiration int32
 
-	// Compare and swap ID.
-	casid uint64
+	// CasID is the compare and swap ID, as returned by Get or by a binary
+	// Set. CompareAndSwap uses it to detect intervening modifications; it
+	// may also be set explicitly, e.g. from a CasID serialized by
+	// another process.
+	CasID uint64
 
 	// opaque
 	opaque uint32
@@ -293,13 +823,62 @@ type conn struct {
 	rw   *bufio.ReadWriter
 	addr net.Addr
 	c    *Client
+
+	// slot is the MaxOpenConns slot held while the connection is in use
+	slot chan struct{}
+
+	// gen is the client's generation when the connection was dialed
+	gen uint64
+
+	// noreplies is the number of noreply commands sent since the last
+	// sync
+	noreplies int
+
+	// broken is set once a write fails, after which the connection is
+	// never reused, whatever error the operation returns
+	broken bool
+
+	// idleSince is when the connection was last returned to the pool
+	idleSince time.Time
+}
+
+// connWriter writes to a connection's net.Conn, marking the connection
+// broken if a write fails.
+type connWriter struct {
+	cn *conn
+}
+
+func (w connWriter) Write(p []byte) (int, error) {
+	n, err := w.cn.nc.Write(p)
+	if err != nil {
+		w.cn.broken = true
+		err = &WriteError{Addr: w.cn.addr, Err: err}
+	}
+	return n, err
 }
 
 // release returns this connection back to the client's free pool
 func (cn *conn) release() {
+	cn.releaseSlot()
 	cn.c.putFreeConn(cn.addr, cn)
 }
 
+// close closes this connection instead of returning it to the pool
+func (cn *conn) close() {
+	cn.releaseSlot()
+	cn.c.lk.Lock()
+	delete(cn.c.inUse, cn)
+	cn.c.lk.Unlock()
+	_ = cn.nc.Close()
+}
+
+func (cn *conn) releaseSlot() {
+	if cn.slot != nil {
+		<-cn.slot
+		cn.slot = nil
+	}
+}
+
 func (cn *conn) extendDeadline() error {
 	return cn.nc.SetDeadline(time.Now().Add(cn.c.netTimeout()))
 }
@@ -309,10 +888,10 @@ func (cn *conn) extendDeadline() error {
 // cache miss).  The purpose is to not recycle TCP connections that
 // are bad.
 func (cn *conn) condRelease(err *error) {
-	if *err == nil || resumableError(*err) {
+	if !cn.broken && (*err == nil || cn.c.resumableError(*err)) {
 		cn.release()
 	} else {
-		_ = cn.nc.Close()
+		cn.close()
 	}
 }
 
@@ -322,12 +901,105 @@ func (c *Client) putFreeConn(addr fmt.Stringer, cn *conn) {
 	if c.freeconn == nil {
 		c.freeconn = make(map[string][]*conn)
 	}
+	delete(c.inUse, cn)
 	freelist := c.freeconn[addr.String()]
-	if len(freelist) >= c.maxIdleConns() {
+	if c.closed || c.DisablePooling || cn.gen != c.gen {
 		cn.nc.Close()
 		return
 	}
-	c.freeconn[addr.String()] = append(freelist, cn)
+	if c.poolStats.Idle == nil {
+		c.poolStats.Idle = make(map[string]IdleStats)
+	}
+	idle := c.poolStats.Idle[addr.String()]
+	if len(freelist) >= c.maxIdleConns(cn.addr) {
+		idle.IdleEvictions++
+		c.poolStats.Idle[addr.String()] = idle
+		cn.nc.Close()
+		return
+	}
+	cn.idleSince = c.timeNow()
+	freelist = append(freelist, cn)
+	c.freeconn[addr.String()] = freelist
+	if len(freelist) > idle.MaxIdleSeen {
+		idle.MaxIdleSeen = len(freelist)
+		c.poolStats.Idle[addr.String()] = idle
+	}
+}
+
+// CloseServer closes and removes all idle connections to the given
+// server, without affecting those to other servers. Connections in use
+// are not affected, and are still returned to the pool when done. This
+// is useful before restarting a single server. An error is returned if
+// addr fails to resolve.
+func (c *Client) CloseServer(addr string) error {
+	naddr, err := resolveAddr(addr)
+	if err != nil {
+		return err
+	}
+	c.lk.Lock()
+	freelist := c.freeconn[naddr.String()]
+	delete(c.freeconn, naddr.String())
+	c.lk.Unlock()
+	for _, cn := range freelist {
+		_ = cn.nc.Close()
+	}
+	return nil
+}
+
+// Reset closes all idle connections, so that later operations dial new
+// ones, while leaving the client usable. Connections in use by in-flight
+// operations are not interrupted, but are closed rather than pooled once
+// those operations complete. This is useful after a failover or other
+// topology change that may have left pooled connections stale.
+func (c *Client) Reset() {
+	c.lk.Lock()
+	freeconn := c.freeconn
+	c.freeconn = nil
+	c.gen++
+	c.lk.Unlock()
+	for _, freelist := range freeconn {
+		for _, cn := range freelist {
+			_ = cn.nc.Close()
+		}
+	}
+}
+
+// Close closes all of the client's connections, including those in use,
+// so that operations blocked on them, such as reads from a stalled
+// server, fail promptly, for a clean shutdown. Operations started
+// afterwards fail with ErrClientClosed. Close affects all of the
+// client's clones.
+func (c *Client) Close() error {
+	c.lk.Lock()
+	c.closed = true
+	freeconn, inUse := c.freeconn, c.inUse
+	c.freeconn, c.inUse = nil, nil
+	c.lk.Unlock()
+	for _, freelist := range freeconn {
+		for _, cn := range freelist {
+			_ = cn.nc.Close()
+		}
+	}
+	for cn := range inUse {
+		_ = cn.nc.Close()
+	}
+	return nil
+}
+
+// trackInUse records that cn is in use, until it is released or closed,
+// so that Close can interrupt it. ErrClientClosed is returned once the
+// client is closed.
+func (c *Client) trackInUse(cn *conn) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	if c.inUse == nil {
+		c.inUse = make(map[*conn]struct{})
+	}
+	c.inUse[cn] = struct{}{}
+	return nil
 }
 
 func (c *Client) getFreeConn(addr fmt.Stringer) (cn *conn, ok bool) {
@@ -345,6 +1017,16 @@ func (c *Client) getFreeConn(addr fmt.Stringer) (cn *conn, ok bool) {
 	return cn, true
 }
 
+// timeNow returns the time on the client's clock, which pool waits,
+// connection lifetimes and retry intervals are measured with. Socket
+// deadlines are set by the kernel's clock, so they use time.Now.
+func (c *Client) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
 func (c *Client) netTimeout() time.Duration {
 	if c.Timeout != 0 {
 		return c.Timeout
@@ -352,7 +1034,72 @@ func (c *Client) netTimeout() time.Duration {
 	return DefaultTimeout
 }
 
-func (c *Client) maxIdleConns() int {
+func (c *Client) serverRetryInterval() time.Duration {
+	if c.ServerRetryInterval > 0 {
+		return c.ServerRetryInterval
+	}
+	return DefaultServerRetryInterval
+}
+
+// markDown records whether addr failed to be dialed
+func (c *Client) markDown(addr net.Addr, down bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if !down {
+		delete(c.down, addr.String())
+		return
+	}
+	if c.down == nil {
+		c.down = make(map[string]time.Time)
+	}
+	c.down[addr.String()] = c.timeNow().Add(c.serverRetryInterval())
+}
+
+// allServersDown reports whether every server of the selector is down
+func (c *Client) allServersDown() bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if len(c.down) == 0 {
+		return false
+	}
+	now := c.timeNow()
+	errUp := errors.New("up")
+	err := c.selector.Each(func(addr net.Addr) error {
+		if retry, ok := c.down[addr.String()]; !ok || !now.Before(retry) {
+			return errUp
+		}
+		return nil
+	})
+	return err == nil
+}
+
+func (c *Client) maxKeysPerRequest() int {
+	if c.MaxKeysPerRequest > 0 {
+		return c.MaxKeysPerRequest
+	}
+	return DefaultMaxKeysPerRequest
+}
+
+func (c *Client) readBufferSize() int {
+	if c.ReadBufferSize > 0 {
+		return c.ReadBufferSize
+	}
+	return DefaultReadBufferSize
+}
+
+func (c *Client) binaryBatchSize() int {
+	if c.BinaryBatchSize > 0 {
+		return c.BinaryBatchSize
+	}
+	return DefaultBinaryBatchSize
+}
+
+func (c *Client) maxIdleConns(addr net.Addr) int {
+	if c.MaxIdleConnsFor != nil {
+		if n := c.MaxIdleConnsFor(addr); n > 0 {
+			return n
+		}
+	}
 	if c.MaxIdleConns > 0 {
 		return c.MaxIdleConns
 	}
@@ -370,78 +1117,610 @@ func (cte *ConnectTimeoutError) Error() string {
 	return "memcache: connect timeout to " + cte.Addr.String()
 }
 
+// Timeout is always true, as for any net.Error timeout.
+func (cte *ConnectTimeoutError) Timeout() bool { return true }
+
+// Temporary is always true, as for any net.Error timeout.
+func (cte *ConnectTimeoutError) Temporary() bool { return true }
+
+// Is makes errors.Is(err, os.ErrDeadlineExceeded) true for a connect
+// timeout. Since read and write timeouts also match
+// os.ErrDeadlineExceeded, use errors.As with a *ConnectTimeoutError to
+// tell a connect timeout apart.
+func (cte *ConnectTimeoutError) Is(target error) bool {
+	return target == os.ErrDeadlineExceeded
+}
+
+// WriteError is the error type used when writing a command to a server
+// fails, including on a write timeout. The command may have been sent
+// in part, which leaves the connection in an unknown state, so it is
+// closed rather than reused.
+type WriteError struct {
+	Addr net.Addr
+	Err  error
+}
+
+func (we *WriteError) Error() string {
+	return "memcache: write to " + we.Addr.String() + " failed: " + we.Err.Error()
+}
+
+// Unwrap returns the underlying write error, so that errors.Is with
+// os.ErrDeadlineExceeded reports a write timeout.
+func (we *WriteError) Unwrap() error { return we.Err }
+
+// Timeout reports whether the write timed out, so that a WriteError is
+// a net.Error like the error it wraps.
+func (we *WriteError) Timeout() bool {
+	ne, ok := we.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Temporary is the same as Timeout.
+func (we *WriteError) Temporary() bool { return we.Timeout() }
+
+// ProtocolError is the error type used when the server rejects a
+// command, naming the command so that protocol version mismatches, such
+// as a server that predates the meta commands, are easy to spot. Use
+// errors.Is with ErrUnknownCommand to test for a bare ERROR reply.
+type ProtocolError struct {
+	// Verb is the command that was rejected, such as "mg" or "gat".
+	Verb string
+	Err  error
+}
+
+func (pe *ProtocolError) Error() string {
+	return "memcache: " + pe.Verb + " command rejected: " + pe.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (pe *ProtocolError) Unwrap() error { return pe.Err }
+
+// CacheMissError is the error type Get returns for a cache miss if
+// WrapMissWithKey is set, naming the key that missed. It matches
+// ErrCacheMiss with errors.Is.
+type CacheMissError struct {
+	Key string
+}
+
+func (me *CacheMissError) Error() string {
+	return ErrCacheMiss.Error() + " for key " + strconv.Quote(me.Key)
+}
+
+// Unwrap returns ErrCacheMiss.
+func (me *CacheMissError) Unwrap() error { return ErrCacheMiss }
+
+// DialError is the error type used when a connection to a server fails
+// for a reason other than a timeout, such as being refused. These
+// failures happen before any command is sent to the server.
+type DialError struct {
+	Addr net.Addr
+	Err  error
+}
+
+func (de *DialError) Error() string {
+	return "memcache: dial " + de.Addr.String() + ": " + de.Err.Error()
+}
+
+// Unwrap returns the underlying dial error.
+func (de *DialError) Unwrap() error { return de.Err }
+
 func (c *Client) dial(addr net.Addr) (net.Conn, error) {
-	nc, err := net.DialTimeout(addr.Network(), addr.String(), c.netTimeout())
-	if err == nil {
+	if c.connect != nil {
+		nc, err := c.connect()
+		if err != nil {
+			return nil, &DialError{Addr: addr, Err: err}
+		}
 		return nc, nil
 	}
 
+	var d net.Dialer
+	if c.Dialer != nil {
+		d = *c.Dialer
+	}
+	d.Timeout = c.netTimeout()
+	nc, err := d.Dial(addr.Network(), addr.String())
+	if err == nil {
+		if err = c.setBufferSizes(nc); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if c.TLSConfig == nil {
+			return nc, nil
+		}
+		tc, err := c.tlsClient(nc, addr)
+		if err != nil {
+			nc.Close()
+			return nil, &DialError{Addr: addr, Err: err}
+		}
+		return tc, nil
+	}
+
 	if ne, ok := err.(net.Error); ok && ne.Timeout() {
 		return nil, &ConnectTimeoutError{addr}
 	}
 
-	return nil, err
+	return nil, &DialError{Addr: addr, Err: err}
 }
 
-func (c *Client) getConn(addr net.Addr) (*conn, error) {
-	cn, ok := c.getFreeConn(addr)
-	if ok {
-		err := cn.extendDeadline()
-		if err != nil {
-			return nil, err
+// setBufferSizes applies SendBufferSize and RecvBufferSize to TCP
+// connections
+func (c *Client) setBufferSizes(nc net.Conn) error {
+	tc, ok := nc.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if c.SendBufferSize > 0 {
+		if err := tc.SetWriteBuffer(c.SendBufferSize); err != nil {
+			return err
 		}
-		return cn, nil
 	}
-	nc, err := c.dial(addr)
-	if err != nil {
-		return nil, err
+	if c.RecvBufferSize > 0 {
+		if err := tc.SetReadBuffer(c.RecvBufferSize); err != nil {
+			return err
+		}
 	}
-	cn = &conn{
-		nc:   nc,
-		addr: addr,
-		c:    c,
-		rw:   bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+	return nil
+}
+
+// acquireSlot waits for one of the MaxOpenConns slots of addr, returning
+// it, or nil if there is no limit.
+func (c *Client) acquireSlot(ctx context.Context, addr net.Addr) (chan struct{}, error) {
+	if c.MaxOpenConns <= 0 {
+		return nil, nil
 	}
-	err = cn.extendDeadline()
+	c.lk.Lock()
+	if c.slots == nil {
+		c.slots = make(map[string]chan struct{})
+	}
+	slot, ok := c.slots[addr.String()]
+	if !ok {
+		slot = make(chan struct{}, c.MaxOpenConns)
+		c.slots[addr.String()] = slot
+	}
+	c.lk.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return slot, nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if c.AcquirePoolTimeout > 0 {
+		t := time.NewTimer(c.AcquirePoolTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	start := c.timeNow()
+	var err error
+	select {
+	case slot <- struct{}{}:
+	case <-timeout:
+		err = ErrPoolTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.lk.Lock()
+	c.poolStats.Waits++
+	c.poolStats.WaitDuration += c.timeNow().Sub(start)
+	if err == ErrPoolTimeout {
+		c.poolStats.Timeouts++
+	}
+	c.lk.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	return cn, nil
+	return slot, nil
 }
 
-func (c *Client) noItemOnItem(item *Item, fn doer) error {
-	_, err := c.onItem(item, fn)
-	return err
+func (c *Client) getConn(addr net.Addr) (*conn, error) {
+	return c.getConnContext(context.Background(), addr)
 }
 
-func (c *Client) onItem(item *Item, fn doer) (*Item, error) {
-	addr, err := c.selector.PickServer(item.Key)
+// getConnContext is like getConn, but stops waiting for a free
+// connection when ctx is done.
+func (c *Client) getConnContext(ctx context.Context, addr net.Addr) (*conn, error) {
+	if c.FailFastWhenNoServers && c.allServersDown() {
+		return nil, ErrNoServers
+	}
+	slot, err := c.acquireSlot(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
-	cn, err := c.getConn(addr)
+	cn, ok := c.getValidFreeConn(addr)
+	if !ok {
+		c.lk.Lock()
+		closed := c.closed
+		c.lk.Unlock()
+		if closed {
+			if slot != nil {
+				<-slot
+			}
+			return nil, ErrClientClosed
+		}
+		nc, err := c.dial(addr)
+		if c.FailFastWhenNoServers {
+			c.markDown(addr, err != nil)
+		}
+		if err != nil {
+			if slot != nil {
+				<-slot
+			}
+			return nil, err
+		}
+		c.lk.Lock()
+		gen := c.gen
+		c.lk.Unlock()
+		cn = &conn{
+			nc:   nc,
+			addr: addr,
+			c:    c,
+			gen:  gen,
+		}
+		cn.rw = bufio.NewReadWriter(bufio.NewReaderSize(nc, c.readBufferSize()), bufio.NewWriter(connWriter{cn}))
+	}
+	cn.slot = slot
+	if err = c.trackInUse(cn); err != nil {
+		cn.close()
+		return nil, err
+	}
+	err = cn.extendDeadline()
+	if err == nil && !ok && c.AutoDetectLimits {
+		err = c.detectLimits(cn)
+	}
 	if err != nil {
+		cn.close()
 		return nil, err
 	}
-	defer cn.condRelease(&err)
-	item, err = fn(cn, item)
-	return item, err
+	return cn, nil
 }
 
-// FlushAll flushes each selector
-func (c *Client) FlushAll() error {
-	return c.selector.Each(c.flushAllFromAddr)
+// getValidFreeConn is like getFreeConn, but first syncs with the
+// connections that noreply commands are pending on, and pings those idle
+// for longer than ValidateIdleAfter, discarding those that fail.
+func (c *Client) getValidFreeConn(addr net.Addr) (*conn, bool) {
+	for {
+		cn, ok := c.getFreeConn(addr)
+		if !ok {
+			return nil, false
+		}
+		// the connection may have been pooled by a clone
+		cn.c = c
+		if cn.noreplies > 0 {
+			// the error of a noreply command mustn't be read as the
+			// reply to the next command
+			if err := cn.extendDeadline(); err == nil {
+				if err = cn.syncNoReply(); err == nil {
+					return cn, true
+				}
+			}
+			_ = cn.nc.Close()
+			continue
+		}
+		if c.ValidateIdleAfter <= 0 || c.timeNow().Sub(cn.idleSince) <= c.ValidateIdleAfter {
+			return cn, true
+		}
+		if err := cn.extendDeadline(); err == nil {
+			if err = c.pingConn(cn); err == nil {
+				return cn, true
+			}
+		}
+		_ = cn.nc.Close()
+	}
 }
 
-// Get gets the item for the given key. ErrCacheMiss is returned for a
-// memcache cache miss. The key must be at most 250 bytes in length.
-func (c *Client) Get(key string) (item *Item, err error) {
-	if c.Binary {
-		return c.onItem(&Item{Key: key}, c.get)
+// validateItem checks item's expiration per ExpirationPolicy and its
+// value with ValidateValue before it is stored
+func (c *Client) validateItem(item *Item) error {
+	if err := c.checkExpiration(item.Expiration); err != nil {
+		return err
+	}
+	if err := c.checkFlags(item.Flags); err != nil {
+		return err
+	}
+	if c.ValidateValue == nil {
+		return nil
+	}
+	return c.ValidateValue(item.Value)
+}
+
+// checkItemSize checks the size of item's value, as it would be stored
+// after compression, against the maximum value size of addr. Values are
+// only compressed to check them if they are over the limit as they are.
+func (c *Client) checkItemSize(addr net.Addr, item *Item) error {
+	max := c.maxValueSize(addr)
+	if max <= 0 || len(item.Value) <= max {
+		return nil
+	}
+	if _, ok := c.compressorFor(item); !ok {
+		return ErrValueTooLarge
+	}
+	value, _, err := c.compressValue(item)
+	if err != nil {
+		return err
+	}
+	if len(value) > max {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// maxValueSize returns the item_size_max of addr found by
+// AutoDetectLimits, if any, or else MaxValueSize
+func (c *Client) maxValueSize(addr net.Addr) int {
+	if c.AutoDetectLimits {
+		c.lk.Lock()
+		n := c.itemSizeMax[addr.String()]
+		c.lk.Unlock()
+		if n > 0 {
+			return n
+		}
+	}
+	return c.MaxValueSize
+}
+
+// detectLimits records the item_size_max of cn's server for
+// AutoDetectLimits, unless already known
+func (c *Client) detectLimits(cn *conn) error {
+	addr := cn.addr.String()
+	c.lk.Lock()
+	_, known := c.itemSizeMax[addr]
+	c.lk.Unlock()
+	if known || c.binaryFor(cn.addr) {
+		return nil
+	}
+	stats, err := c.statsFromRw(cn.rw, "settings")
+	if err != nil && err != ErrNoStats && !errors.Is(err, ErrUnknownCommand) {
+		return err
+	}
+	n, _ := strconv.Atoi(stats["item_size_max"])
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.itemSizeMax == nil {
+		c.itemSizeMax = make(map[string]int)
+	}
+	c.itemSizeMax[addr] = n
+	return nil
+}
+
+// ExpirationPolicy is how a Client treats expirations, see
+// Client.ExpirationPolicy.
+type ExpirationPolicy int
+
+const (
+	// ExpirationRaw passes expirations to the server as they are, so
+	// that those over MaxRelativeExpiration are absolute Unix times.
+	ExpirationRaw ExpirationPolicy = iota
+	// ExpirationRelativeSeconds only accepts expirations of at most
+	// MaxRelativeExpiration, which the server treats as seconds from
+	// now. Larger ones fail with ErrExpirationTooLarge, rather than
+	// being taken as absolute times, long past, at which the item
+	// would expire at once.
+	ExpirationRelativeSeconds
+)
+
+// MaxRelativeExpiration is the largest expiration, 30 days in seconds,
+// that memcached treats as relative to now rather than as a Unix time.
+const MaxRelativeExpiration = 30 * 24 * 60 * 60
+
+func (c *Client) checkExpiration(exp int32) error {
+	if c.ExpirationPolicy == ExpirationRelativeSeconds && exp > MaxRelativeExpiration {
+		return ErrExpirationTooLarge
+	}
+	return nil
+}
+
+func (c *Client) noItemOnItem(item *Item, fn doer) error {
+	_, err := c.onItem(item, fn)
+	return err
+}
+
+func (c *Client) onItem(item *Item, fn doer) (*Item, error) {
+	addr, err := c.selector.PickServer(item.Key)
+	if err != nil {
+		return nil, err
+	}
+	return c.onAddr(addr, item, fn)
+}
+
+func (c *Client) onAddr(addr net.Addr, item *Item, fn doer) (res *Item, err error) {
+	if err := c.checkItemSize(addr, item); err != nil {
+		return nil, err
+	}
+	err = c.withRetries(func() (err error) {
+		cn, err := c.getConn(addr)
+		if err != nil {
+			return err
+		}
+		defer cn.condRelease(&err)
+		if c.AutoDetectLimits {
+			// the first connection to addr may have just found its limit
+			if err = c.checkItemSize(addr, item); err != nil {
+				return err
+			}
+		}
+		res, err = fn(cn, item)
+		return err
+	})
+	return res, err
+}
+
+// DefaultRetryIf is the RetryIf used if it is nil. It accepts the errors
+// of connections that couldn't be dialed, or failed while the operation
+// was being sent, before the server could have processed it whole.
+func DefaultRetryIf(err error) bool {
+	var de *DialError
+	var cte *ConnectTimeoutError
+	var we *WriteError
+	return errors.As(err, &de) || errors.As(err, &cte) || errors.As(err, &we)
+}
+
+// withRetries calls fn, and again, up to MaxRetries times, for as long
+// as it fails with an error accepted by RetryIf
+func (c *Client) withRetries(fn func() error) error {
+	retryIf := c.RetryIf
+	if retryIf == nil {
+		retryIf = DefaultRetryIf
+	}
+	err := fn()
+	for i := 0; i < c.MaxRetries && err != nil && retryIf(err); i++ {
+		err = fn()
+	}
+	return err
+}
+
+// Servers returns the addresses of the servers the client's selector is
+// currently configured with. If the selector's membership changes at
+// runtime, later calls reflect the change.
+func (c *Client) Servers() []string {
+	var servers []string
+	_ = c.selector.Each(func(addr net.Addr) error {
+		servers = append(servers, addr.String())
+		return nil
+	})
+	return servers
+}
+
+// Distribution reports how the selector places keys across servers,
+// counting the keys picked for each server, so that a sample of keys
+// can be checked for hot spots. It doesn't contact any server. Keys for
+// which the selector returns an error, e.g. because there are no
+// servers, aren't counted.
+func (c *Client) Distribution(keys []string) map[net.Addr]int {
+	dist := make(map[net.Addr]int)
+	for _, key := range keys {
+		addr, err := c.selector.PickServer(key)
+		if err != nil {
+			continue
+		}
+		dist[addr]++
+	}
+	return dist
+}
+
+// RawCommand sends request, which must be a complete command including
+// its line terminator, to server on a pooled connection and calls
+// readResponse to parse the reply. This allows commands this package
+// doesn't model, such as vendor extensions, to be sent. If readResponse
+// returns an error, the connection is closed rather than reused since
+// its framing is unknown, and the error is returned.
+func (c *Client) RawCommand(server net.Addr, request []byte, readResponse func(*bufio.Reader) error) error {
+	cn, err := c.getConn(server)
+	if err != nil {
+		return err
+	}
+	if _, err = cn.rw.Write(request); err == nil {
+		err = cn.rw.Flush()
+	}
+	if err == nil {
+		err = readResponse(cn.rw.Reader)
+	}
+	if err != nil {
+		cn.close()
+		return err
+	}
+	cn.release()
+	return nil
+}
+
+// SetMemLimit changes the memory limit of the given server to megabytes
+// at runtime, using the "cache_memlimit" command. Memory limits are per
+// server, so only the given server is affected.
+func (c *Client) SetMemLimit(server net.Addr, megabytes int) error {
+	if c.binaryFor(server) {
+		return ErrUnsupported
+	}
+	return c.withAddrRw(server, func(rw *bufio.ReadWriter) error {
+		return c.writeExpectf(rw, resultOK, "cache_memlimit %d\r\n", megabytes)
+	})
+}
+
+// FlushAll flushes each selector
+func (c *Client) FlushAll() error {
+	return c.selector.Each(c.flushAllFromAddr)
+}
+
+// FlushServers flushes only the given servers, which must all be in the
+// selector's current server set. No server is flushed if any of them
+// isn't.
+func (c *Client) FlushServers(addrs []string) error {
+	configured := make(map[string]net.Addr)
+	_ = c.selector.Each(func(addr net.Addr) error {
+		configured[addr.String()] = addr
+		return nil
+	})
+	targets := make([]net.Addr, len(addrs))
+	for i, a := range addrs {
+		naddr, err := resolveAddr(a)
+		if err != nil {
+			return err
+		}
+		addr, ok := configured[naddr.String()]
+		if !ok {
+			return fmt.Errorf("memcache: %s is not a configured server", a)
+		}
+		targets[i] = addr
+	}
+	for _, addr := range targets {
+		if err := c.flushAllFromAddr(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get gets the item for the given key. ErrCacheMiss is returned for a
+// memcache cache miss, as a *CacheMissError if WrapMissWithKey is set.
+// The key must be at most 250 bytes in length. An item stored with an
+// empty value is a hit, and its Value is an empty, non-nil slice.
+func (c *Client) Get(key string) (item *Item, err error) {
+	c.accessKey("get", key)
+	if c.knownMiss(key) {
+		return nil, c.missError(key)
+	}
+	item, err = c.getKey(key)
+	if err == ErrCacheMiss {
+		c.rememberMiss(key)
+		err = c.missError(key)
+	}
+	if c.OnUnavailable != nil && unavailableError(err) {
+		if value, ok := c.OnUnavailable("get", key); ok {
+			return &Item{Key: key, Value: value}, nil
+		}
+	}
+	return item, err
+}
+
+// unavailableError reports whether err means that a server couldn't be
+// reached at all, for OnUnavailable
+func unavailableError(err error) bool {
+	var de *DialError
+	var cte *ConnectTimeoutError
+	return err == ErrNoServers || errors.As(err, &de) || errors.As(err, &cte)
+}
+
+// missError returns the error for a miss of key per WrapMissWithKey
+func (c *Client) missError(key string) error {
+	if c.WrapMissWithKey {
+		return &CacheMissError{Key: key}
+	}
+	return ErrCacheMiss
+}
+
+func (c *Client) getKey(key string) (item *Item, err error) {
+	if addrs, err := c.replicas(key); err != nil {
+		return nil, err
+	} else if addrs != nil {
+		return c.getReplicas(addrs, key)
 	}
 	err = c.withKeyAddr(key, func(addr net.Addr) error {
-		return c.getFromAddr(addr, []string{key}, func(it *Item) {
+		if c.binaryFor(addr) {
+			item, err = c.onAddr(addr, &Item{Key: key}, c.get)
+			return err
+		}
+		return c.getFromAddr(addr, nil, []string{key}, func(it *Item) error {
 			item = it
+			return nil
 		})
 	})
 	if err == nil && item == nil {
@@ -450,12 +1729,44 @@ func (c *Client) Get(key string) (item *Item, err error) {
 	return
 }
 
+// Lookup is like Get, but reports a cache miss as a false ok with a nil
+// error rather than as ErrCacheMiss.
+func (c *Client) Lookup(key string) (item *Item, ok bool, err error) {
+	item, err = c.Get(key)
+	if errors.Is(err, ErrCacheMiss) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return item, true, nil
+}
+
 // only callable as binary
 func (c *Client) get(cn *conn, item *Item) (*Item, error) {
-	if !c.Binary {
+	if !c.binaryFor(cn.addr) {
 		panic("Only binary mode allowewd here!")
 	}
-	return c.binaryPopulate(cn.nc, opGet, item)
+	// GETK echoes the key, which guards against a proxy or routing bug
+	// answering with another key's item
+	resp, err := c.binaryPopulate(cn.rw, opGetK, item)
+	var bs *errBadStatus
+	if errors.As(err, &bs) && bs.op == statusKeyEnoent {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Key != item.Key {
+		return nil, ErrProtocol
+	}
+	if len(resp.extras) == 4 {
+		resp.Flags = binary.BigEndian.Uint32(resp.extras)
+	}
+	if err := c.decompress(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 // Touch updates the expiry for the given key. The seconds parameter is either
@@ -464,14 +1775,18 @@ func (c *Client) get(cn *conn, item *Item) (*Item, error) {
 // no expiration time. ErrCacheMiss is returned if the key is not in the cache.
 // The key must be at most 250 bytes in length.
 func (c *Client) Touch(key string, seconds int32) (err error) {
+	c.accessKey("touch", key)
+	if err := c.checkExpiration(seconds); err != nil {
+		return err
+	}
 	return c.withKeyAddr(key, func(addr net.Addr) error {
 		return c.touchFromAddr(addr, []string{key}, seconds)
 	})
 }
 
 func (c *Client) withKeyAddr(key string, fn func(net.Addr) error) (err error) {
-	if !c.legalKey(key) {
-		return ErrMalformedKey
+	if err := c.ValidateKey(key); err != nil {
+		return err
 	}
 	addr, err := c.selector.PickServer(key)
 	if err != nil {
@@ -480,38 +1795,155 @@ func (c *Client) withKeyAddr(key string, fn func(net.Addr) error) (err error) {
 	return fn(addr)
 }
 
-func (c *Client) withAddrRw(addr net.Addr, fn func(*bufio.ReadWriter) error) (err error) {
-	cn, err := c.getConn(addr)
+func (c *Client) withAddrRw(addr net.Addr, fn func(*bufio.ReadWriter) error) error {
+	return c.withRetries(func() (err error) {
+		cn, err := c.getConn(addr)
+		if err != nil {
+			return err
+		}
+		defer cn.condRelease(&err)
+		return fn(cn.rw)
+	})
+}
+
+func (c *Client) withKeyRw(key string, fn func(*bufio.ReadWriter) error) error {
+	return c.withKeyAddr(key, func(addr net.Addr) error {
+		if c.binaryFor(addr) {
+			return ErrUnsupported
+		}
+		return c.withAddrRw(addr, fn)
+	})
+}
+
+// binaryFor reports whether addr is spoken to with the binary protocol,
+// which is the case for every server if Binary is set, and otherwise
+// for those a ProtocolSelector marks as binary.
+func (c *Client) binaryFor(addr net.Addr) bool {
+	if c.Binary {
+		return true
+	}
+	ps, ok := c.selector.(ProtocolSelector)
+	return ok && ps.IsBinary(addr)
+}
+
+// withAddrRwContext is like withAddrRw, but aborts the I/O in progress
+// when ctx is done, which also closes the connection.
+func (c *Client) withAddrRwContext(ctx context.Context, addr net.Addr, fn func(*bufio.ReadWriter) error) (err error) {
+	cn, err := c.getConnContext(ctx, addr)
 	if err != nil {
 		return err
 	}
 	defer cn.condRelease(&err)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = cn.nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
 	err = fn(cn.rw)
+	close(stop)
+	<-stopped
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	return err
 }
 
-func (c *Client) withKeyRw(key string, fn func(*bufio.ReadWriter) error) error {
-	if c.Binary {
-		return ErrUnsupported
+func (c *Client) getFromAddr(addr net.Addr, budget *readBudget, keys []string, cb func(*Item) error) error {
+	return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+		return c.getKeys(rw, c.binaryFor(addr), budget, keys, cb)
+	})
+}
+
+// getFromAddrContext is like getFromAddr, but stops when ctx is done
+func (c *Client) getFromAddrContext(ctx context.Context, addr net.Addr, budget *readBudget, keys []string, cb func(*Item) error) error {
+	if ctx.Done() == nil {
+		// never done, so there is nothing to watch
+		return c.getFromAddr(addr, budget, keys, cb)
 	}
-	return c.withKeyAddr(key, func(addr net.Addr) error {
-		return c.withAddrRw(addr, fn)
+	return c.withAddrRwContext(ctx, addr, func(rw *bufio.ReadWriter) error {
+		return c.getKeys(rw, c.binaryFor(addr), budget, keys, cb)
 	})
 }
 
-func (c *Client) getFromAddr(addr net.Addr, keys []string, cb func(*Item)) error {
-	return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
-		if _, err := fmt.Fprintf(rw, "gets %s\r\n", strings.Join(keys, " ")); err != nil {
+// readBudget is the number of value bytes that a multi-get may still
+// read, shared by the connections reading its responses. A nil budget is
+// unlimited.
+type readBudget struct {
+	mu   sync.Mutex
+	left int
+}
+
+// newReadBudget returns a budget of max bytes, or nil if max isn't
+// positive
+func newReadBudget(max int) *readBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &readBudget{left: max}
+}
+
+// take takes n bytes from b before a value of that size is read,
+// returning ErrResponseTooLarge if there aren't as many left
+func (b *readBudget) take(n int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.left {
+		b.left = 0
+		return ErrResponseTooLarge
+	}
+	b.left -= n
+	return nil
+}
+
+// getKeys fetches keys on rw using the binary or text protocol, calling
+// cb for each item found, decompressed, and failing with
+// ErrResponseTooLarge before reading a value larger than what is left of
+// budget
+func (c *Client) getKeys(rw *bufio.ReadWriter, binary bool, budget *readBudget, keys []string, cb func(*Item) error) error {
+	found := cb
+	cb = func(it *Item) error {
+		if err := c.decompress(it); err != nil {
 			return err
 		}
-		if err := rw.Flush(); err != nil {
-			return err
+		return found(it)
+	}
+	if binary {
+		return c.binaryGetMulti(rw, budget, keys, cb)
+	}
+	batch := c.maxKeysPerRequest()
+	for start := 0; start < len(keys); start += batch {
+		end := start + batch
+		if end > len(keys) {
+			end = len(keys)
 		}
-		if err := parseGetResponse(rw.Reader, cb); err != nil {
+		if err := c.getKeysText(rw, budget, keys[start:end], cb); err != nil {
 			return err
 		}
-		return nil
-	})
+	}
+	return nil
+}
+
+// getKeysText sends a gets command for keys on rw and calls cb for each
+// item in the response
+func (c *Client) getKeysText(rw *bufio.ReadWriter, budget *readBudget, keys []string, cb func(*Item) error) error {
+	if _, err := fmt.Fprintf(rw, "gets %s\r\n", strings.Join(keys, " ")); err != nil {
+		return err
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	if err := c.parseGetResponse(rw.Reader, budget, cb); err != nil {
+		return err
+	}
+	return nil
 }
 
 // flushAllFromAddr send the flush_all command to the given addr
@@ -523,7 +1955,7 @@ func (c *Client) flushAllFromAddr(addr net.Addr) error {
 		if err := rw.Flush(); err != nil {
 			return err
 		}
-		line, err := rw.ReadSlice('\n')
+		line, err := c.readLine(rw.Reader)
 		if err != nil {
 			return err
 		}
@@ -531,13 +1963,16 @@ func (c *Client) flushAllFromAddr(addr net.Addr) error {
 		case bytes.Equal(line, resultOk):
 			break
 		default:
-			return fmt.Errorf("memcache: unexpected response line from flush_all: %q", string(line))
+			return unexpectedResponse("flush_all", line)
 		}
 		return nil
 	})
 }
 
 func (c *Client) touchFromAddr(addr net.Addr, keys []string, expiration int32) error {
+	if c.binaryFor(addr) {
+		return ErrUnsupported
+	}
 	return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
 		for _, key := range keys {
 			if _, err := fmt.Fprintf(rw, "touch %s %d\r\n", key, expiration); err != nil {
@@ -546,7 +1981,7 @@ func (c *Client) touchFromAddr(addr net.Addr, keys []string, expiration int32) e
 			if err := rw.Flush(); err != nil {
 				return err
 			}
-			line, err := rw.ReadSlice('\n')
+			line, err := c.readLine(rw.Reader)
 			if err != nil {
 				return err
 			}
@@ -556,7 +1991,7 @@ func (c *Client) touchFromAddr(addr net.Addr, keys []string, expiration int32) e
 			case bytes.Equal(line, resultNotFound):
 				return ErrCacheMiss
 			default:
-				return fmt.Errorf("memcache: unexpected response line from touch: %q", string(line))
+				return unexpectedResponse("touch", line)
 			}
 		}
 		return nil
@@ -568,73 +2003,300 @@ func (c *Client) touchFromAddr(addr net.Addr, keys []string, expiration int32) e
 // cache misses. Each key must be at most 250 bytes in length.
 // If no error is returned, the returned map will also be non-nil.
 func (c *Client) GetMulti(keys []string) (map[string]*Item, error) {
-	if c.Binary {
-		return nil, ErrUnsupported
+	return c.getMulti(keys, c.GetMultiOnError)
+}
+
+// getMulti is GetMulti, handling servers that fail per policy
+func (c *Client) getMulti(keys []string, policy GetMultiErrorPolicy) (map[string]*Item, error) {
+	c.accessKeys("get", keys)
+	keyMap, err := c.keysByAddr(keys)
+	if err != nil {
+		return nil, err
 	}
-	var lk sync.Mutex
+	return c.getMultiFromAddrs(keyMap, policy)
+}
+
+// getMultiFromAddrs gets the keys of keyMap into a map, within
+// MaxMultiGetBytes, handling servers that fail per policy
+func (c *Client) getMultiFromAddrs(keyMap map[net.Addr][]string, policy GetMultiErrorPolicy) (map[string]*Item, error) {
 	m := make(map[string]*Item)
-	addItemToMap := func(it *Item) {
+	err := c.getFromAddrs(context.Background(), policy, newReadBudget(c.MaxMultiGetBytes), keyMap, func(it *Item) error {
+		m[it.Key] = it
+		return nil
+	})
+	if err == ErrResponseTooLarge || err != nil && policy == GetMultiFail {
+		return nil, err
+	}
+	return m, err
+}
+
+// GetMultiFunc is like GetMulti, but calls fn for each item found as it
+// is read off the wire instead of collecting the items in a map, so
+// that large key sets can be processed without holding all of their
+// values in memory. Calls to fn are serialized. If fn returns an error,
+// no more items are passed to it, the connections whose responses were
+// still being read are closed, and the error is returned.
+func (c *Client) GetMultiFunc(keys []string, fn func(*Item) error) error {
+	c.accessKeys("get", keys)
+	keyMap, err := c.keysByAddr(keys)
+	if err != nil {
+		return err
+	}
+	return c.getFromAddrs(context.Background(), c.GetMultiOnError, nil, keyMap, fn)
+}
+
+// GetMultiStream is like GetMultiFunc, but also stops when ctx is done:
+// no more items are passed to fn, the connections whose responses were
+// still being read are closed, and ctx's error is returned. This suits
+// pipelines processing very large key sets that must be cancellable.
+func (c *Client) GetMultiStream(ctx context.Context, keys []string, fn func(*Item) error) error {
+	c.accessKeys("get", keys)
+	keyMap, err := c.keysByAddr(keys)
+	if err != nil {
+		return err
+	}
+	return c.getFromAddrs(ctx, c.GetMultiOnError, nil, keyMap, fn)
+}
+
+// getFromAddrs gets the keys of keyMap from their servers in parallel,
+// calling cb for each item found, until ctx is done or the values read
+// exceed budget, and handling servers that fail per policy. Calls to cb
+// are serialized, and once it returns an error it isn't called again and
+// the error is returned.
+func (c *Client) getFromAddrs(ctx context.Context, policy GetMultiErrorPolicy, budget *readBudget, keyMap map[net.Addr][]string, cb func(*Item) error) error {
+	var lk sync.Mutex
+	var cbErr error
+	serialCb := func(it *Item) error {
 		lk.Lock()
 		defer lk.Unlock()
-		m[it.Key] = it
+		if cbErr == nil {
+			if cbErr = ctx.Err(); cbErr == nil {
+				cbErr = cb(it)
+			}
+		}
+		return cbErr
 	}
 
-	keyMap := make(map[net.Addr][]string)
-	for _, key := range keys {
-		if !c.legalKey(key) {
-			return nil, ErrMalformedKey
+	get := func(addr net.Addr, keys []string) error {
+		err := c.getFromAddrContext(ctx, addr, budget, keys, serialCb)
+		lk.Lock()
+		failedCb := cbErr != nil
+		lk.Unlock()
+		if err != nil && !failedCb && ctx.Err() == nil && err != ErrResponseTooLarge && policy == GetMultiSkip {
+			if c.OnGetMultiSkip != nil {
+				c.OnGetMultiSkip(addr, keys, err)
+			}
+			return nil
 		}
-		addr, err := c.selector.PickServer(key)
-		if err != nil {
-			return nil, err
+		return err
+	}
+
+	var err error
+	if len(keyMap) == 1 {
+		// no fan-out needed, e.g. for a SingleEndpoint proxy
+		for addr, keys := range keyMap {
+			err = get(addr, keys)
 		}
-		keyMap[addr] = append(keyMap[addr], key)
+	} else {
+		ch := make(chan error, buffered)
+		for addr, keys := range keyMap {
+			go func(addr net.Addr, keys []string) {
+				ch <- get(addr, keys)
+			}(addr, keys)
+		}
+		for range keyMap {
+			if ge := <-ch; ge != nil {
+				err = ge
+			}
+		}
+	}
+	if cbErr != nil {
+		return cbErr
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// GetMultiErrorPolicy is how GetMulti and GetMultiFunc handle the
+// servers that fail, such as unreachable ones.
+type GetMultiErrorPolicy int
+
+const (
+	// GetMultiPartial returns the items of the servers that succeeded
+	// along with one of the errors of the servers that failed. It is the
+	// default.
+	GetMultiPartial GetMultiErrorPolicy = iota
+	// GetMultiSkip treats the keys of the servers that failed as misses,
+	// favoring availability: no error is returned for them, and
+	// OnGetMultiSkip, if set, is called instead. Errors returned by the
+	// function given to GetMultiFunc are still returned.
+	GetMultiSkip
+	// GetMultiFail fails the whole call, favoring correctness: GetMulti
+	// returns no items, as GetMultiStrict does.
+	GetMultiFail
+)
+
+// GetMultiOption is an option of GetMultiContext.
+type GetMultiOption func(*getMultiOptions)
+
+type getMultiOptions struct {
+	shardTimeout time.Duration
+}
+
+// WithShardTimeout bounds the round trip to each server by d,
+// independently of the others and within ctx's own deadline. A server
+// exceeding it is abandoned, and its connection closed, while the others
+// complete. The failures of servers, whether timeouts or other errors,
+// are then reported as a ServerErrors along with the items of the other
+// servers.
+func WithShardTimeout(d time.Duration) GetMultiOption {
+	return func(o *getMultiOptions) {
+		o.shardTimeout = d
 	}
+}
 
-	ch := make(chan error, buffered)
+// GetMultiContext is like GetMulti, but returns when ctx is done even if
+// some servers haven't responded yet. In that case the items collected
+// from the servers that did respond are returned along with
+// ErrPartialResult, and the connections to the slow servers are closed.
+func (c *Client) GetMultiContext(ctx context.Context, keys []string, opts ...GetMultiOption) (map[string]*Item, error) {
+	c.accessKeys("get", keys)
+	var o getMultiOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var lk sync.Mutex
+	m := make(map[string]*Item)
+	abandoned := false
+	budget := newReadBudget(c.MaxMultiGetBytes)
+	addItemToMap := func(it *Item) error {
+		lk.Lock()
+		defer lk.Unlock()
+		if !abandoned {
+			m[it.Key] = it
+		}
+		return nil
+	}
+
+	keyMap, err := c.keysByAddr(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	type shardResult struct {
+		addr net.Addr
+		err  error
+	}
+	ch := make(chan shardResult, len(keyMap))
 	for addr, keys := range keyMap {
 		go func(addr net.Addr, keys []string) {
-			ch <- c.getFromAddr(addr, keys, addItemToMap)
+			shardCtx := ctx
+			if o.shardTimeout > 0 {
+				var cancel context.CancelFunc
+				shardCtx, cancel = context.WithTimeout(ctx, o.shardTimeout)
+				defer cancel()
+			}
+			ch <- shardResult{addr, c.withAddrRwContext(shardCtx, addr, func(rw *bufio.ReadWriter) error {
+				return c.getKeys(rw, c.binaryFor(addr), budget, keys, addItemToMap)
+			})}
 		}(addr, keys)
 	}
 
-	var err error
+	errs := make(ServerErrors)
 	for range keyMap {
-		if ge := <-ch; ge != nil {
-			err = ge
+		select {
+		case res := <-ch:
+			if res.err == ErrResponseTooLarge {
+				lk.Lock()
+				defer lk.Unlock()
+				abandoned = true
+				return nil, res.err
+			}
+			if res.err != nil {
+				err = res.err
+				errs[res.addr] = res.err
+			}
+		case <-ctx.Done():
+			lk.Lock()
+			defer lk.Unlock()
+			abandoned = true
+			return m, ErrPartialResult
 		}
 	}
+	if o.shardTimeout > 0 && len(errs) > 0 {
+		return m, errs
+	}
 	return m, err
 }
 
+// keysByAddr validates keys and groups them by the server they're on
+func (c *Client) keysByAddr(keys []string) (map[net.Addr][]string, error) {
+	keyMap := make(map[net.Addr][]string)
+	for _, key := range keys {
+		if err := c.ValidateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if se, ok := c.selector.(*SingleEndpoint); ok {
+		// the proxy does its own distribution, so there is nothing to group
+		if len(keys) == 0 {
+			return keyMap, nil
+		}
+		addr, err := se.PickServer("")
+		if err != nil {
+			return nil, err
+		}
+		keyMap[addr] = keys
+		return keyMap, nil
+	}
+	for _, key := range keys {
+		addr, err := c.selector.PickServer(key)
+		if err != nil {
+			return nil, err
+		}
+		keyMap[addr] = append(keyMap[addr], key)
+	}
+	return keyMap, nil
+}
+
+// GetMultiStrict is like GetMulti, but all-or-nothing: if any server
+// returns an error, no items are returned. A key missing from the
+// returned map is therefore always a genuine cache miss, whatever the
+// client's GetMultiOnError.
+func (c *Client) GetMultiStrict(keys []string) (map[string]*Item, error) {
+	return c.getMulti(keys, GetMultiFail)
+}
+
 // parseGetResponse reads a GET response from r and calls cb for each
 // read and allocated Item
-func parseGetResponse(r *bufio.Reader, cb func(*Item)) error {
+func (c *Client) parseGetResponse(r *bufio.Reader, budget *readBudget, cb func(*Item) error) error {
 	for {
-		line, err := r.ReadSlice('\n')
+		line, err := c.readLine(r)
 		if err != nil {
 			return err
 		}
 		if bytes.Equal(line, resultEnd) {
 			return nil
 		}
+		if bytes.Equal(line, resultError) {
+			return &ProtocolError{Verb: "gets", Err: ErrUnknownCommand}
+		}
 		it := new(Item)
 		size, err := scanGetResponseLine(line, it)
 		if err != nil {
 			return err
 		}
-		it.Value = make([]byte, size+2)
-		_, err = io.ReadFull(r, it.Value)
-		if err != nil {
-			it.Value = nil
+		if err := budget.take(size); err != nil {
+			return err
+		}
+		if it.Value, err = c.readValue(r, size); err != nil {
 			return err
 		}
-		if !bytes.HasSuffix(it.Value, crlf) {
-			it.Value = nil
-			return fmt.Errorf("memcache: corrupt get result read")
+		if err := cb(it); err != nil {
+			return err
 		}
-		it.Value = it.Value[:size]
-		cb(it)
 	}
 }
 
@@ -642,7 +2304,7 @@ func parseGetResponse(r *bufio.Reader, cb func(*Item)) error {
 // It does not read the bytes of the item.
 func scanGetResponseLine(line []byte, it *Item) (size int, err error) {
 	pattern := "VALUE %s %d %d %d\r\n"
-	dest := []interface{}{&it.Key, &it.Flags, &size, &it.casid}
+	dest := []interface{}{&it.Key, &it.Flags, &size, &it.CasID}
 	if bytes.Count(line, space) == 3 {
 		pattern = "VALUE %s %d %d\r\n"
 		dest = dest[:3]
@@ -654,42 +2316,208 @@ func scanGetResponseLine(line []byte, it *Item) (size int, err error) {
 	return size, nil
 }
 
-// Set writes the given item, unconditionally.
-func (c *Client) Set(item *Item) error {
-	return c.noItemOnItem(item, c.set)
+// Set writes the given item, unconditionally. In binary mode, the
+// item's CasID is updated to that of the stored item.
+func (c *Client) Set(item *Item) error {
+	c.accessKey("set", item.Key)
+	if err := c.validateItem(item); err != nil {
+		return err
+	}
+	if addrs, err := c.replicas(item.Key); err != nil {
+		return err
+	} else if addrs != nil {
+		return c.storeReplicas(addrs, item, c.set)
+	}
+	return c.noItemOnItem(item, c.set)
+}
+
+func (c *Client) set(cn *conn, item *Item) (*Item, error) {
+	if c.binaryFor(cn.addr) {
+		stored := *item
+		var err error
+		if stored.Value, stored.Flags, err = c.compressValue(item); err != nil {
+			return nil, err
+		}
+		resp, err := c.binaryPopulate(cn.rw, opSet, &stored)
+		if err != nil {
+			return nil, err
+		}
+		item.CasID = resp.CasID
+		c.forgetMiss(item.Key)
+		return resp, nil
+	}
+	if err := c.populateOne(cn.rw, "set", item); err != nil {
+		return nil, err
+	}
+	c.forgetMiss(item.Key)
+	return nil, nil
+}
+
+// SetMulti writes the given items, unconditionally. Items on the same
+// server are pipelined over a single connection, and each item's own
+// Flags and Expiration are honored. If any items fail to be stored,
+// one of the errors is returned.
+func (c *Client) SetMulti(items []*Item) error {
+	for _, item := range items {
+		c.accessKey("set", item.Key)
+	}
+	if c.Binary {
+		return ErrUnsupported
+	}
+	itemMap := make(map[net.Addr][]*Item)
+	var sizeErr error
+	for _, item := range items {
+		if err := c.ValidateKey(item.Key); err != nil {
+			return err
+		}
+		if err := c.validateItem(item); err != nil {
+			return err
+		}
+		addr, err := c.selector.PickServer(item.Key)
+		if err != nil {
+			return err
+		}
+		if c.binaryFor(addr) {
+			return ErrUnsupported
+		}
+		if err := c.checkItemSize(addr, item); err != nil {
+			sizeErr = err
+			continue
+		}
+		itemMap[addr] = append(itemMap[addr], item)
+	}
+
+	ch := make(chan error, len(itemMap))
+	for addr, items := range itemMap {
+		go func(addr net.Addr, items []*Item) {
+			ch <- c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+				var sizeErr error
+				if c.AutoDetectLimits {
+					// the first connection to addr may have just found
+					// its limit
+					items, sizeErr = c.dropOversize(addr, items)
+				}
+				// some items may be stored despite an error
+				defer func() {
+					for _, item := range items {
+						c.forgetMiss(item.Key)
+					}
+				}()
+				if err := c.populateMulti(rw, "set", items); err != nil {
+					return err
+				}
+				return sizeErr
+			})
+		}(addr, items)
+	}
+
+	err := sizeErr
+	for range itemMap {
+		if se := <-ch; se != nil {
+			err = se
+		}
+	}
+	return err
 }
 
-func (c *Client) set(cn *conn, item *Item) (*Item, error) {
-	if c.Binary {
-		return c.binaryPopulate(cn.nc, opSet, item)
+// dropOversize returns the items whose values are within the maximum
+// value size of addr, and ErrValueTooLarge if any aren't
+func (c *Client) dropOversize(addr net.Addr, items []*Item) ([]*Item, error) {
+	var err error
+	kept := items[:0:0]
+	for _, item := range items {
+		if ie := c.checkItemSize(addr, item); ie != nil {
+			err = ie
+			continue
+		}
+		kept = append(kept, item)
 	}
-	return nil, c.populateOne(cn.rw, "set", item)
+	return kept, err
 }
 
 // Add writes the given item, if no value already exists for its
 // key. ErrNotStored is returned if that condition is not met.
 func (c *Client) Add(item *Item) error {
+	c.accessKey("add", item.Key)
+	if err := c.validateItem(item); err != nil {
+		return err
+	}
+	if addrs, err := c.replicas(item.Key); err != nil {
+		return err
+	} else if addrs != nil {
+		return c.storeReplicas(addrs, item, c.add)
+	}
 	return c.noItemOnItem(item, c.add)
 }
 
 func (c *Client) add(cn *conn, item *Item) (*Item, error) {
-	if c.Binary {
+	if c.binaryFor(cn.addr) {
 		return nil, ErrUnsupported
 	}
-	return nil, c.populateOne(cn.rw, "add", item)
+	if err := c.populateOne(cn.rw, "add", item); err != nil {
+		return nil, err
+	}
+	c.forgetMiss(item.Key)
+	return nil, nil
 }
 
 // Replace writes the given item, but only if the server *does*
 // already hold data for this key
 func (c *Client) Replace(item *Item) error {
+	c.accessKey("replace", item.Key)
+	if err := c.validateItem(item); err != nil {
+		return err
+	}
+	if addrs, err := c.replicas(item.Key); err != nil {
+		return err
+	} else if addrs != nil {
+		return c.storeReplicas(addrs, item, c.replace)
+	}
 	return c.noItemOnItem(item, c.replace)
 }
 
 func (c *Client) replace(cn *conn, item *Item) (*Item, error) {
-	if c.Binary {
+	if c.binaryFor(cn.addr) {
+		return nil, ErrUnsupported
+	}
+	if err := c.populateOne(cn.rw, "replace", item); err != nil {
+		return nil, err
+	}
+	c.forgetMiss(item.Key)
+	return nil, nil
+}
+
+// Append appends the given item's value to the value already stored for
+// its key. ErrNotStored is returned if the key doesn't exist. The
+// item's Flags and Expiration are ignored: as per the protocol, the
+// stored item keeps its own flags and expiration time, so a later Get
+// returns the flags it was stored with.
+func (c *Client) Append(item *Item) error {
+	c.accessKey("append", item.Key)
+	return c.noItemOnItem(item, c.append)
+}
+
+func (c *Client) append(cn *conn, item *Item) (*Item, error) {
+	if c.binaryFor(cn.addr) {
+		return nil, ErrUnsupported
+	}
+	return nil, c.populateOne(cn.rw, "append", item)
+}
+
+// Prepend prepends the given item's value to the value already stored
+// for its key. ErrNotStored is returned if the key doesn't exist. As
+// with Append, the item's Flags and Expiration are ignored, and the
+// stored item keeps its own.
+func (c *Client) Prepend(item *Item) error {
+	c.accessKey("prepend", item.Key)
+	return c.noItemOnItem(item, c.prepend)
+}
+
+func (c *Client) prepend(cn *conn, item *Item) (*Item, error) {
+	if c.binaryFor(cn.addr) {
 		return nil, ErrUnsupported
 	}
-	return nil, c.populateOne(cn.rw, "replace", item)
+	return nil, c.populateOne(cn.rw, "prepend", item)
 }
 
 // CompareAndSwap writes the given item that was previously returned
@@ -699,15 +2527,31 @@ func (c *Client) replace(cn *conn, item *Item) (*Item, error) {
 // is returned if the value was modified in between the
 // calls. ErrNotStored is returned if the value was evicted in between
 // the calls.
+//
+// The item need not come from this client: only its CasID is compared,
+// so a CasID obtained elsewhere, e.g. passed along from another
+// service, may be set on a new Item. ErrNoCasID is returned if CasID
+// is zero.
 func (c *Client) CompareAndSwap(item *Item) error {
+	c.accessKey("cas", item.Key)
+	if err := c.validateItem(item); err != nil {
+		return err
+	}
 	return c.noItemOnItem(item, c.cas)
 }
 
 func (c *Client) cas(cn *conn, item *Item) (*Item, error) {
-	if c.Binary {
+	if item.CasID == 0 {
+		return nil, ErrNoCasID
+	}
+	if c.binaryFor(cn.addr) {
 		return nil, ErrUnsupported
 	}
-	return nil, c.populateOne(cn.rw, "cas", item)
+	if err := c.populateOne(cn.rw, "cas", item); err != nil {
+		return nil, err
+	}
+	c.forgetMiss(item.Key)
+	return nil, nil
 }
 
 // TODO finish more than SET and GET
@@ -718,7 +2562,7 @@ func binaryRequest(b *bytes.Buffer, op byte, item *Item) (*bytes.Buffer, error)
 	switch op {
 	case opSet:
 		extraLength = 8
-	case opGet:
+	case opGet, opGetK, opGetKQ, opNoop, opDelete:
 		extraLength = 0
 	default:
 		panic("unsupported operation")
@@ -743,17 +2587,21 @@ func binaryRequest(b *bytes.Buffer, op byte, item *Item) (*bytes.Buffer, error)
 	f(op)
 	f(uint16(len(item.Key))) // key length
 	f(extraLength)
-	f(byte(0x00)) // data type
-	f(uint16(0))  // status or vbucket
-	f(totalBody)  // total body
-	f(uint32(0))  // opaque
-	f(uint64(0))  // CAS
+	f(byte(0x00))  // data type
+	f(uint16(0))   // status or vbucket
+	f(totalBody)   // total body
+	f(item.opaque) // opaque
+	if op == opDelete {
+		f(item.CasID) // CAS
+	} else {
+		f(uint64(0)) // CAS
+	}
 	// extras
 	switch op {
 	case opSet:
 		g(item.Flags)
 		g(item.Expiration)
-	case opGet:
+	case opGet, opGetK, opGetKQ, opNoop, opDelete:
 		break
 	default:
 		panic("unsupported operation")
@@ -769,64 +2617,80 @@ func binaryRequest(b *bytes.Buffer, op byte, item *Item) (*bytes.Buffer, error)
 	return body, nil
 }
 
-func (c *Client) binaryPopulate(conn io.ReadWriter, op byte, item *Item) (*Item, error) {
-	if !c.legalKey(item.Key) {
-		return nil, ErrMalformedKey
+// binaryPopulate sends a single binary request for op and reads its
+// response. The request is written in one flush and the response is read
+// through rw's buffer, keeping syscalls to a minimum.
+func (c *Client) binaryPopulate(rw *bufio.ReadWriter, op byte, item *Item) (*Item, error) {
+	if err := c.ValidateKey(item.Key); err != nil {
+		return nil, err
 	}
 	b := make([]byte, headerSize)
 	headerBuff := bytes.NewBuffer(b)
-	body, err := binaryRequest(headerBuff, op, item)
-	if err != nil {
+	if err := writeBinaryRequest(rw, headerBuff, op, item); err != nil {
 		return nil, err
 	}
-	_, err = conn.Write(headerBuff.Bytes())
-	if err != nil {
+	if err := rw.Flush(); err != nil {
 		return nil, err
 	}
-	if body.Len() > 0 {
-		_, err = conn.Write(body.Bytes())
-		if err != nil {
-			return nil, err
-		}
-	}
-	return binaryResponse(b, conn, op)
+	return binaryResponse(b, rw, op)
 }
 
 // TODO maybe use an arena for the body buff
 func binaryResponse(headerBuff []byte, conn io.Reader, op byte) (*Item, error) {
-	_, err := io.ReadFull(conn, headerBuff)
+	responseItem, opCode, err := readBinaryResponse(headerBuff, conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opCode != op {
+		return nil, ErrWrongOp
+	}
+	err = responseItem.validateResponse(op)
 	if err != nil {
 		return nil, err
 	}
+	return responseItem, nil
+}
+
+// readBinaryResponse reads a single binary response of any op, returning
+// the op it was for. Its value is taken from budget before it is read.
+func readBinaryResponse(headerBuff []byte, conn io.Reader, budget *readBudget) (*Item, byte, error) {
+	_, err := io.ReadFull(conn, headerBuff)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	magic := headerBuff[0]
 	if magic != resMagic {
-		return nil, ErrWrongMagic
+		return nil, 0, ErrWrongMagic
 	}
 	opCode := headerBuff[1]
-	if opCode != op {
-		return nil, ErrWrongOp
-	}
 	keyLen := int(binary.BigEndian.Uint16(headerBuff[2:4]))
 	extraLen := int(headerBuff[4])
 
 	status := binary.BigEndian.Uint16(headerBuff[6:8])
 	if status != statusSuccess {
-		return nil, &errBadStatus{op: status}
+		// skip the error message so the next response can be read
+		if _, err := io.CopyN(io.Discard, conn, int64(binary.BigEndian.Uint32(headerBuff[8:12]))); err != nil {
+			return nil, opCode, err
+		}
+		return nil, opCode, &errBadStatus{op: status}
 	}
 
 	opaque := binary.BigEndian.Uint32(headerBuff[12:16])
 	cas := binary.BigEndian.Uint64(headerBuff[16:24])
 
 	bodyLen := int(binary.BigEndian.Uint32(headerBuff[8:12])) - (keyLen + extraLen)
+	if err := budget.take(bodyLen); err != nil {
+		return nil, opCode, err
+	}
 
 	buf := make([]byte, keyLen+extraLen+bodyLen)
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
-		return nil, err
+		return nil, opCode, err
 	}
 
-	responseItem := &Item{casid: cas, opaque: opaque}
+	responseItem := &Item{CasID: cas, opaque: opaque}
 	if extraLen > 0 {
 		responseItem.extras = buf[0:extraLen]
 	}
@@ -836,44 +2700,149 @@ func binaryResponse(headerBuff []byte, conn io.Reader, op byte) (*Item, error) {
 	if keyLen+extraLen > 0 {
 		responseItem.Value = buf[keyLen+extraLen:]
 	}
+	return responseItem, opCode, nil
+}
 
-	err = responseItem.validateResponse(op)
+// binaryGetMulti pipelines a quiet GETKQ for each of keys on rw. Since
+// misses produce no response, each batch of BinaryBatchSize keys is
+// terminated by a NOOP, whose response marks the end of the batch. This
+// bounds the unread responses so that neither side can block on a full
+// socket buffer. Each request carries a unique opaque value that the
+// server echoes, which is used to match hits to their keys regardless of
+// the order they arrive in.
+func (c *Client) binaryGetMulti(rw *bufio.ReadWriter, budget *readBudget, keys []string, cb func(*Item) error) error {
+	b := make([]byte, headerSize)
+	headerBuff := bytes.NewBuffer(b)
+	batch := c.binaryBatchSize()
+	for start := 0; start < len(keys); start += batch {
+		end := start + batch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		// opaque i+1 is keys[start+i], and 0 is the NOOP
+		for i, key := range keys[start:end] {
+			if err := writeBinaryRequest(rw, headerBuff, opGetKQ, &Item{Key: key, opaque: uint32(i + 1)}); err != nil {
+				return err
+			}
+		}
+		if err := writeBinaryRequest(rw, headerBuff, opNoop, &Item{}); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		for {
+			it, op, err := readBinaryResponse(b, rw, budget)
+			if err != nil {
+				return err
+			}
+			if op == opNoop {
+				break
+			}
+			if op != opGetKQ {
+				return ErrWrongOp
+			}
+			if it.opaque < 1 || int(it.opaque) > end-start {
+				return fmt.Errorf("memcache: unexpected opaque %d in binary get response", it.opaque)
+			}
+			key := keys[start+int(it.opaque)-1]
+			if it.Key != "" && it.Key != key {
+				return fmt.Errorf("memcache: binary get response for %q has key %q", key, it.Key)
+			}
+			it.Key = key
+			if len(it.extras) == 4 {
+				it.Flags = binary.BigEndian.Uint32(it.extras)
+			}
+			if err := cb(it); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeBinaryRequest writes a binary request for op to w
+func writeBinaryRequest(w io.Writer, headerBuff *bytes.Buffer, op byte, item *Item) error {
+	body, err := binaryRequest(headerBuff, op, item)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return responseItem, nil
+	if _, err = w.Write(headerBuff.Bytes()); err != nil {
+		return err
+	}
+	_, err = w.Write(body.Bytes())
+	return err
 }
 
 func (c *Client) writeItem(rw *bufio.ReadWriter, verb string, item *Item) error {
+	value, flags, exp := item.Value, item.Flags, item.Expiration
 	var err error
+	// appended and prepended data can't be compressed on its own, and
+	// the server ignores their flags and expiration, keeping the stored
+	// item's; zeros make it plain that they aren't changed
+	if verb == "append" || verb == "prepend" {
+		flags, exp = 0, 0
+	} else if value, flags, err = c.compressValue(item); err != nil {
+		return err
+	}
 	if verb == "cas" {
 		_, err = fmt.Fprintf(rw, "%s %s %d %d %d %d\r\n",
-			verb, item.Key, item.Flags, item.Expiration, len(item.Value), item.casid)
+			verb, item.Key, flags, exp, len(value), item.CasID)
 	} else {
 		_, err = fmt.Fprintf(rw, "%s %s %d %d %d\r\n",
-			verb, item.Key, item.Flags, item.Expiration, len(item.Value))
+			verb, item.Key, flags, exp, len(value))
 	}
 	if err != nil {
 		return err
 	}
-	if _, err = rw.Write(item.Value); err != nil {
+	if _, err = rw.Write(value); err != nil {
 		return err
 	}
 	if _, err = rw.Write(crlf); err != nil {
 		return err
 	}
-	if err = rw.Flush(); err != nil {
-		return err
-	}
 	return nil
 }
 
 func (c *Client) populateOne(rw *bufio.ReadWriter, verb string, item *Item) error {
-	if !c.legalKey(item.Key) {
-		return ErrMalformedKey
+	if err := c.ValidateKey(item.Key); err != nil {
+		return err
+	}
+	if err := c.writeItem(rw, verb, item); err != nil {
+		return err
 	}
-	err := c.writeItem(rw, verb, item)
-	line, err := rw.ReadSlice('\n')
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	return c.readStoreResponse(rw.Reader, verb)
+}
+
+// populateMulti pipelines a storage command for each of items, then
+// reads all of the responses. The last item error is returned.
+func (c *Client) populateMulti(rw *bufio.ReadWriter, verb string, items []*Item) error {
+	for _, item := range items {
+		if err := c.writeItem(rw, verb, item); err != nil {
+			return err
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	var err error
+	for range items {
+		if ie := c.readStoreResponse(rw.Reader, verb); ie != nil {
+			if !resumableError(ie) {
+				return ie
+			}
+			err = ie
+		}
+	}
+	return err
+}
+
+// readStoreResponse reads the response line of a storage command
+func (c *Client) readStoreResponse(r *bufio.Reader, verb string) error {
+	line, err := c.readLine(r)
 	if err != nil {
 		return err
 	}
@@ -887,10 +2856,56 @@ func (c *Client) populateOne(rw *bufio.ReadWriter, verb string, item *Item) erro
 	case bytes.Equal(line, resultNotFound):
 		return ErrCacheMiss
 	}
-	return fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
+	return unexpectedResponse(verb, line)
+}
+
+// readLine reads a response line from r. If LenientLineEndings is set, a
+// line ending in a bare "\n" is returned ending in "\r\n", as a copy, so
+// that it can be parsed as any other line.
+func (c *Client) readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || !c.LenientLineEndings || bytes.HasSuffix(line, crlf) {
+		return line, err
+	}
+	return append(line[:len(line)-1:len(line)-1], crlf...), nil
+}
+
+// readValue reads a data block of size bytes from r, along with the line
+// ending that follows it, which must be "\r\n", or also a bare "\n" if
+// LenientLineEndings is set. ErrProtocol is returned for any other
+// ending.
+func (c *Client) readValue(r *bufio.Reader, size int) ([]byte, error) {
+	value := make([]byte, size+2)
+	if !c.LenientLineEndings {
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(value, crlf) {
+			return nil, ErrProtocol
+		}
+		return value[:size], nil
+	}
+	// read one byte less, since the ending may be a bare "\n"
+	if _, err := io.ReadFull(r, value[:size+1]); err != nil {
+		return nil, err
+	}
+	switch value[size] {
+	case '\n':
+	case '\r':
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != '\n' {
+			return nil, ErrProtocol
+		}
+	default:
+		return nil, ErrProtocol
+	}
+	return value[:size], nil
 }
 
-func writeReadLine(rw *bufio.ReadWriter, format string, args ...interface{}) ([]byte, error) {
+func (c *Client) writeReadLine(rw *bufio.ReadWriter, format string, args ...interface{}) ([]byte, error) {
 	_, err := fmt.Fprintf(rw, format, args...)
 	if err != nil {
 		return nil, err
@@ -898,11 +2913,11 @@ func writeReadLine(rw *bufio.ReadWriter, format string, args ...interface{}) ([]
 	if err = rw.Flush(); err != nil {
 		return nil, err
 	}
-	return rw.ReadSlice('\n')
+	return c.readLine(rw.Reader)
 }
 
-func writeExpectf(rw *bufio.ReadWriter, expect []byte, format string, args ...interface{}) error {
-	line, err := writeReadLine(rw, format, args...)
+func (c *Client) writeExpectf(rw *bufio.ReadWriter, expect []byte, format string, args ...interface{}) error {
+	line, err := c.writeReadLine(rw, format, args...)
 	if err != nil {
 		return err
 	}
@@ -918,22 +2933,268 @@ func writeExpectf(rw *bufio.ReadWriter, expect []byte, format string, args ...in
 	case bytes.Equal(line, resultNotFound):
 		return ErrCacheMiss
 	}
-	return fmt.Errorf("memcache: unexpected response line: %q", string(line))
+	return unexpectedResponse(strings.Fields(format)[0], line)
 }
 
 // Delete deletes the item with the provided key. The error ErrCacheMiss is
 // returned if the item didn't already exist in the cache.
 func (c *Client) Delete(key string) error {
+	c.accessKey("delete", key)
+	if addrs, err := c.replicas(key); err != nil {
+		return err
+	} else if addrs != nil {
+		return c.deleteReplicas(addrs, key)
+	}
 	return c.withKeyRw(key, func(rw *bufio.ReadWriter) error {
-		return writeExpectf(rw, resultDeleted, "delete %s\r\n", key)
+		return c.writeExpectf(rw, resultDeleted, "delete %s\r\n", key)
+	})
+}
+
+// DeleteCAS deletes the item with the provided key, but only if its CAS
+// ID still matches cas, as returned by Get, so that a value another
+// client stored in between isn't deleted. ErrCASConflict is returned if
+// the item was modified, and ErrCacheMiss if it doesn't exist. The text
+// protocol's delete doesn't take a CAS ID, so servers that don't speak
+// the binary protocol are sent the meta protocol's "md" instead.
+// ErrNoCasID is returned if cas is zero, which the server would take to
+// mean an unconditional delete.
+func (c *Client) DeleteCAS(key string, cas uint64) error {
+	c.accessKey("delete", key)
+	if cas == 0 {
+		return ErrNoCasID
+	}
+	return c.withKeyAddr(key, func(addr net.Addr) error {
+		if c.binaryFor(addr) {
+			_, err := c.onAddr(addr, &Item{Key: key, CasID: cas}, c.deleteCAS)
+			return err
+		}
+		return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+			_, err := c.metaCmd(rw, "md", key, []string{"C" + strconv.FormatUint(cas, 10)}, nil)
+			return err
+		})
 	})
 }
 
-// DeleteAll deletes all items in the cache.
+// only callable as binary
+func (c *Client) deleteCAS(cn *conn, item *Item) (*Item, error) {
+	_, err := c.binaryPopulate(cn.rw, opDelete, item)
+	var bs *errBadStatus
+	if errors.As(err, &bs) {
+		switch bs.op {
+		case statusKeyEnoent:
+			return nil, ErrCacheMiss
+		case statusKeyExists:
+			return nil, ErrCASConflict
+		}
+	}
+	return nil, err
+}
+
+// Rename moves the item of oldKey to newKey, by getting oldKey, adding
+// its value and flags as newKey, and deleting oldKey. ErrCacheMiss is
+// returned if oldKey is absent, and ErrNotStored if newKey already
+// exists, in which case it is left untouched. The item's expiration
+// isn't preserved, since reads don't report it; newKey doesn't expire.
+//
+// Rename is best-effort rather than atomic, since memcached has no
+// native rename. Both keys exist between the Add and the Delete, and an
+// update of oldKey by another client after the Get is lost. A CAS-based
+// variant narrows that race: rather than deleting oldKey, CompareAndSwap
+// it, with the CasID from the Get, to a short-lived tombstone, so that
+// an intervening update makes it fail with ErrCASConflict instead of
+// being deleted.
+func (c *Client) Rename(oldKey, newKey string) error {
+	item, err := c.Get(oldKey)
+	if err != nil {
+		return err
+	}
+	if err := c.Add(&Item{Key: newKey, Value: item.Value, Flags: item.Flags}); err != nil {
+		return err
+	}
+	if err := c.Delete(oldKey); err != nil && err != ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// DeleteAll deletes all items in the cache by flushing every server in
+// parallel. If any servers fail, the returned error is a ServerErrors.
 func (c *Client) DeleteAll() error {
-	return c.withKeyRw("", func(rw *bufio.ReadWriter) error {
-		return writeExpectf(rw, resultDeleted, "flush_all\r\n")
+	if c.Binary {
+		return ErrUnsupported
+	}
+	return c.eachParallel(func(addr net.Addr) error {
+		if c.binaryFor(addr) {
+			return ErrUnsupported
+		}
+		return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+			return c.writeExpectf(rw, resultDeleted, "flush_all\r\n")
+		})
+	})
+}
+
+// Unreachable is the latency LatencyProbe reports for a server that
+// couldn't be probed.
+const Unreachable = time.Duration(math.MaxInt64)
+
+// LatencyProbe measures the round trip time to each server in parallel,
+// using a "version" command, or a no-op in binary mode, on a pooled
+// connection. The time to dial a new connection isn't included. Servers
+// that fail, e.g. because they can't be dialed, are reported with a
+// latency of Unreachable, and their errors are returned as a
+// ServerErrors along with the latencies of all servers.
+func (c *Client) LatencyProbe() (map[net.Addr]time.Duration, error) {
+	var mu sync.Mutex
+	latencies := make(map[net.Addr]time.Duration)
+	err := c.eachParallel(func(addr net.Addr) error {
+		rtt, err := c.ping(addr)
+		if err != nil {
+			rtt = Unreachable
+		}
+		mu.Lock()
+		latencies[addr] = rtt
+		mu.Unlock()
+		return err
+	})
+	if err == ErrNoServers {
+		return nil, err
+	}
+	return latencies, err
+}
+
+// ping times a round trip to addr
+func (c *Client) ping(addr net.Addr) (rtt time.Duration, err error) {
+	cn, err := c.getConn(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer cn.condRelease(&err)
+	start := c.timeNow()
+	err = c.pingConn(cn)
+	return c.timeNow().Sub(start), err
+}
+
+// pingConn makes a round trip on cn with a "version" command, or a no-op
+// in binary mode
+func (c *Client) pingConn(cn *conn) error {
+	if c.binaryFor(cn.addr) {
+		_, err := c.binaryPopulate(cn.rw, opNoop, &Item{})
+		return err
+	}
+	line, err := c.writeReadLine(cn.rw, "version\r\n")
+	if err == nil && !bytes.HasPrefix(line, resultVersionPrefix) {
+		err = unexpectedResponse("version", line)
+	}
+	return err
+}
+
+// SupportsBinary reports whether all of the client's servers speak the
+// binary protocol, so that callers can fall back to the text protocol at
+// startup rather than setting Binary and failing on every operation.
+// Each server is sent a binary no-op on a new connection, which is
+// closed afterwards; servers that only speak the text protocol reply
+// with "ERROR". Servers that fail otherwise are returned as a
+// ServerErrors.
+func (c *Client) SupportsBinary() (bool, error) {
+	var mu sync.Mutex
+	supported := true
+	err := c.eachParallel(func(addr net.Addr) error {
+		ok, err := c.supportsBinary(addr)
+		if err == nil && !ok {
+			mu.Lock()
+			supported = false
+			mu.Unlock()
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return supported, nil
+}
+
+// supportsBinary probes addr with a binary no-op
+func (c *Client) supportsBinary(addr net.Addr) (bool, error) {
+	nc, err := c.dial(addr)
+	if err != nil {
+		return false, err
+	}
+	defer nc.Close()
+	if err := nc.SetDeadline(time.Now().Add(c.netTimeout())); err != nil {
+		return false, err
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	b := make([]byte, headerSize)
+	if err := writeBinaryRequest(rw, bytes.NewBuffer(b), opNoop, &Item{}); err != nil {
+		return false, err
+	}
+	if err := rw.Flush(); err != nil {
+		return false, err
+	}
+	magic, err := rw.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if magic[0] != resMagic {
+		line, err := c.readLine(rw.Reader)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(line, resultError) {
+			return false, unexpectedResponse("noop", line)
+		}
+		return false, nil
+	}
+	if _, err := binaryResponse(b, rw, opNoop); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// eachParallel calls fn once for each distinct server, with at most
+// fanOutLimit calls running at once. The failures are returned as a
+// ServerErrors.
+func (c *Client) eachParallel(fn func(net.Addr) error) error {
+	seen := make(map[string]bool)
+	var addrs []net.Addr
+	_ = c.selector.Each(func(addr net.Addr) error {
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			addrs = append(addrs, addr)
+		}
+		return nil
 	})
+	if len(addrs) == 0 {
+		return ErrNoServers
+	}
+	return parallel(addrs, fn)
+}
+
+// parallel calls fn once for each of addrs, with at most fanOutLimit
+// calls running at once. The failures are returned as a ServerErrors.
+func parallel(addrs []net.Addr, fn func(net.Addr) error) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(ServerErrors)
+	sem := make(chan struct{}, fanOutLimit)
+	for _, addr := range addrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr net.Addr) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(addr); err != nil {
+				mu.Lock()
+				errs[addr] = err
+				mu.Unlock()
+			}
+		}(addr)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 // Increment atomically increments key by delta. The return value is
@@ -942,6 +3203,7 @@ func (c *Client) DeleteAll() error {
 // memcached must be an decimal number, or an error will be returned.
 // On 64-bit overflow, the new value wraps around.
 func (c *Client) Increment(key string, delta uint64) (newValue uint64, err error) {
+	c.accessKey("incr", key)
 	return c.incrDecr("incr", key, delta)
 }
 
@@ -952,13 +3214,31 @@ func (c *Client) Increment(key string, delta uint64) (newValue uint64, err error
 // On underflow, the new value is capped at zero and does not wrap
 // around.
 func (c *Client) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	c.accessKey("decr", key)
 	return c.incrDecr("decr", key, delta)
 }
 
+// GetCounter gets the value of key, as stored by Set or updated by
+// Increment and Decrement, and parses it as a base-10 uint64.
+// ErrCacheMiss is returned if key is absent, and an error naming key if
+// its value isn't a number. The trailing spaces Decrement may leave in
+// a value are ignored.
+func (c *Client) GetCounter(key string) (uint64, error) {
+	it, err := c.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(string(bytes.TrimRight(it.Value, " ")), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("memcache: value of %q isn't a counter: %q", key, it.Value)
+	}
+	return n, nil
+}
+
 func (c *Client) incrDecr(verb, key string, delta uint64) (uint64, error) {
 	var val uint64
 	err := c.withKeyRw(key, func(rw *bufio.ReadWriter) error {
-		line, err := writeReadLine(rw, "%s %s %d\r\n", verb, key, delta)
+		line, err := c.writeReadLine(rw, "%s %s %d\r\n", verb, key, delta)
 		if err != nil {
 			return err
 		}
@@ -968,6 +3248,8 @@ func (c *Client) incrDecr(verb, key string, delta uint64) (uint64, error) {
 		case bytes.HasPrefix(line, resultClientErrorPrefix):
 			errMsg := line[len(resultClientErrorPrefix) : len(line)-2]
 			return errors.New("memcache: client error: " + string(errMsg))
+		case bytes.Equal(line, resultError):
+			return &ProtocolError{Verb: verb, Err: ErrUnknownCommand}
 		}
 		val, err = strconv.ParseUint(string(line[:len(line)-2]), 10, 64)
 		return err
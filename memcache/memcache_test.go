@@ -18,14 +18,23 @@ limitations under the License.
 package memcache
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -48,6 +57,119 @@ func setup(t *testing.T) bool {
 	return true
 }
 
+// fakeServer starts a TCP server that calls handle for each command line
+// it reads, and returns its address. Responses written to rw are flushed
+// after handle returns.
+func fakeServer(t testing.TB, handle func(line string, rw *bufio.ReadWriter)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFake(nc, handle)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveFake serves nc for fakeServer until it is closed
+func serveFake(nc net.Conn, handle func(line string, rw *bufio.ReadWriter)) {
+	defer nc.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		handle(strings.TrimRight(line, "\r\n"), rw)
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
+
+// memoryServer serves gets, set, append and mg from an in-memory map, reporting a
+// fixed remaining TTL for every item along with its flags. It also returns a function that
+// reads an item's stored value.
+func memoryServer(t testing.TB, ttl int) (string, func(key string) string) {
+	var mu sync.Mutex
+	items := make(map[string]string)
+	flags := make(map[string]uint32)
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		f := strings.Fields(line)
+		mu.Lock()
+		defer mu.Unlock()
+		switch f[0] {
+		case "gets":
+			for _, key := range f[1:] {
+				if v, ok := items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s %d %d 1\r\n%s\r\n", key, flags[key], len(v), v)
+				}
+			}
+			fmt.Fprintf(rw, "END\r\n")
+		case "mg":
+			if v, ok := items[f[1]]; ok {
+				if containsString(f[2:], "v") {
+					fmt.Fprintf(rw, "VA %d t%d f%d s%d\r\n%s\r\n", len(v), ttl, flags[f[1]], len(v), v)
+				} else {
+					fmt.Fprintf(rw, "HD t%d f%d s%d\r\n", ttl, flags[f[1]], len(v))
+				}
+			} else {
+				fmt.Fprintf(rw, "EN\r\n")
+			}
+		case "set", "add":
+			var n int
+			var fl uint32
+			fmt.Sscanf(f[2], "%d", &fl)
+			fmt.Sscanf(f[4], "%d", &n)
+			buf := make([]byte, n+2)
+			io.ReadFull(rw, buf)
+			if _, ok := items[f[1]]; ok && f[0] == "add" {
+				fmt.Fprintf(rw, "NOT_STORED\r\n")
+				return
+			}
+			items[f[1]] = string(buf[:n])
+			flags[f[1]] = fl
+			fmt.Fprintf(rw, "STORED\r\n")
+		case "append", "prepend":
+			var n int
+			fmt.Sscanf(f[4], "%d", &n)
+			buf := make([]byte, n+2)
+			io.ReadFull(rw, buf)
+			v, ok := items[f[1]]
+			if !ok {
+				fmt.Fprintf(rw, "NOT_STORED\r\n")
+				return
+			}
+			// the item keeps its flags, as with memcached
+			if f[0] == "append" {
+				items[f[1]] = v + string(buf[:n])
+			} else {
+				items[f[1]] = string(buf[:n]) + v
+			}
+			fmt.Fprintf(rw, "STORED\r\n")
+		case "delete":
+			if _, ok := items[f[1]]; !ok {
+				fmt.Fprintf(rw, "NOT_FOUND\r\n")
+				return
+			}
+			delete(items, f[1])
+			fmt.Fprintf(rw, "DELETED\r\n")
+		}
+	})
+	return addr, func(key string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return items[key]
+	}
+}
+
 func TestLocalhost(t *testing.T) {
 	if !setup(t) {
 		return
@@ -126,15 +248,25 @@ func doSetGetAdd(t *testing.T, c *Client) {
 		t.Errorf("get(Hello_世界) Value = %q, want hello world", string(it.Value))
 	}
 
+	// Set and get an empty value, which is a hit rather than a miss
+	empty := &Item{Key: "empty", Value: []byte{}}
+	err = c.Set(empty)
+	checkErr(t, err, "set(empty): %v", err)
+	it, err = c.Get("empty")
+	checkErr(t, err, "get(empty): %v", err)
+	if it.Value == nil || len(it.Value) != 0 {
+		t.Errorf("get(empty) Value = %#v, want empty non-nil slice", it.Value)
+	}
+
 	// Set malformed keys
 	malFormed := &Item{Key: "foo bar", Value: []byte("foobarval")}
 	err = c.Set(malFormed)
-	if err != ErrMalformedKey {
+	if !errors.Is(err, ErrMalformedKey) {
 		t.Errorf("set(foo bar) should return ErrMalformedKey instead of %v", err)
 	}
-	malFormed = &Item{Key: "foo" + string(0x7f), Value: []byte("foobarval")}
+	malFormed = &Item{Key: "foo" + string(rune(0x7f)), Value: []byte("foobarval")}
 	err = c.Set(malFormed)
-	if err != ErrMalformedKey {
+	if !errors.Is(err, ErrMalformedKey) {
 		t.Errorf("set(foo<0x7f>) should return ErrMalformedKey instead of %v", err)
 	}
 
@@ -152,6 +284,27 @@ func doSetGetAdd(t *testing.T, c *Client) {
 	}
 	err = c.Replace(bar)
 	checkErr(t, err, "replaced(foo): %v", err)
+
+	// Append and Prepend
+	err = c.Append(&Item{Key: "baz", Value: []byte("!")})
+	if err != ErrNotStored {
+		t.Fatalf("expected append(baz) to return ErrNotStored, got %v", err)
+	}
+	qux = &Item{Key: "qux", Value: []byte("b"), Flags: 7}
+	err = c.Set(qux)
+	checkErr(t, err, "set(qux): %v", err)
+	err = c.Append(&Item{Key: "qux", Value: []byte("c"), Flags: 9})
+	checkErr(t, err, "append(qux): %v", err)
+	err = c.Prepend(&Item{Key: "qux", Value: []byte("a")})
+	checkErr(t, err, "prepend(qux): %v", err)
+	it, err = c.Get("qux")
+	checkErr(t, err, "get(qux): %v", err)
+	if string(it.Value) != "abc" {
+		t.Errorf("get(qux) Value = %q, want abc", string(it.Value))
+	}
+	if it.Flags != 7 {
+		t.Errorf("get(qux) Flags = %d, want the original 7", it.Flags)
+	}
 }
 
 func doGetMultiDelete(t *testing.T, c *Client) {
@@ -229,7 +382,7 @@ func testWithClient(t *testing.T, c *Client) {
 	doIncrDecr(t, c)
 
 	testTouchWithClient(t, c)
-
+	testSetMultiExpirationWithClient(t, c)
 }
 
 func testBinary(t *testing.T, c *Client) {
@@ -250,6 +403,7 @@ func testBinary(t *testing.T, c *Client) {
 		err := c.Set(i)
 		if tc.pass {
 			assert.NoError(t, err)
+			assert.NotZero(t, i.CasID)
 			resp, err2 := c.Get(tc.key)
 			assert.NoError(t, err2)
 			assert.Equal(t, tc.value, resp.Value)
@@ -260,8 +414,10 @@ func testBinary(t *testing.T, c *Client) {
 	i := &Item{Key: "key", Value: []byte("value")}
 	err := c.Add(i)
 	assert.Equal(t, ErrUnsupported, err)
-	_, err = c.GetMulti([]string{})
-	assert.Equal(t, ErrUnsupported, err)
+	m, err := c.GetMulti([]string{"nospaces", "can haz spaces", "missing"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+	assert.Equal(t, []byte("yaynospaces"), m["nospaces"].Value)
 	err = c.Delete("key")
 	assert.Equal(t, ErrUnsupported, err)
 	err = c.DeleteAll()
@@ -319,6 +475,1131 @@ func testTouchWithClient(t *testing.T, c *Client) {
 	}
 }
 
+func testSetMultiExpirationWithClient(t *testing.T, c *Client) {
+	if testing.Short() {
+		t.Log("Skipping testing memcache SetMulti expiration with testing in Short mode")
+		return
+	}
+
+	// each item expires independently, two seconds apart
+	items := []*Item{
+		{Key: "ttl1", Value: []byte("1"), Flags: 1, Expiration: 1},
+		{Key: "ttl3", Value: []byte("3"), Flags: 3, Expiration: 3},
+		{Key: "ttl5", Value: []byte("5"), Flags: 5, Expiration: 5},
+	}
+	setTime := time.Now()
+	err := c.SetMulti(items)
+	checkErr(t, err, "SetMulti: %v", err)
+	for _, item := range items {
+		it, err := c.Get(item.Key)
+		checkErr(t, err, "get(%s): %v", item.Key, err)
+		if it.Flags != item.Flags {
+			t.Errorf("get(%s) Flags = %v, want %v", item.Key, it.Flags, item.Flags)
+		}
+	}
+	for s := range items {
+		time.Sleep(time.Until(setTime.Add(time.Duration(2500+2000*s) * time.Millisecond)))
+		for i, item := range items {
+			_, err := c.Get(item.Key)
+			if i <= s && err != ErrCacheMiss {
+				t.Errorf("after %v: get(%s) want ErrCacheMiss, got %v", time.Since(setTime), item.Key, err)
+			}
+			if i > s && err != nil {
+				t.Errorf("after %v: get(%s) want hit, got %v", time.Since(setTime), item.Key, err)
+			}
+		}
+	}
+}
+
+func TestSetMulti(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		f := strings.Fields(line)
+		var n int
+		fmt.Sscanf(f[4], "%d", &n)
+		io.ReadFull(rw, make([]byte, n+2))
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+		fmt.Fprintf(rw, "STORED\r\n")
+	})
+	c := New(addr)
+	err := c.SetMulti([]*Item{
+		{Key: "a", Value: []byte("1"), Flags: 1, Expiration: 10},
+		{Key: "b", Value: []byte("22"), Flags: 2, Expiration: 20},
+		{Key: "c", Value: []byte("333"), Flags: 3, Expiration: 30},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"set a 1 10 1", "set b 2 20 2", "set c 3 30 3"}, lines)
+}
+
+// binaryServer serves binary protocol requests from an in-memory map.
+// Only the ops used by the tests are implemented.
+func binaryServer(t testing.TB, items map[string]string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveBinary(nc, items)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveBinary holds back quiet responses until the next NOOP and then
+// sends them in reverse order, so clients can't rely on their order.
+func serveBinary(nc net.Conn, items map[string]string) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	var quiet [][]byte
+	for {
+		hdr := make([]byte, headerSize)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return
+		}
+		op := hdr[1]
+		keyLen := int(binary.BigEndian.Uint16(hdr[2:4]))
+		extraLen := int(hdr[4])
+		body := make([]byte, binary.BigEndian.Uint32(hdr[8:12]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		key := string(body[extraLen : extraLen+keyLen])
+		res := make([]byte, headerSize)
+		res[0] = resMagic
+		res[1] = op
+		copy(res[12:16], hdr[12:16]) // opaque
+		switch op {
+		case opGetKQ:
+			val, ok := items[key]
+			if !ok {
+				continue
+			}
+			binary.BigEndian.PutUint16(res[2:4], uint16(len(key)))
+			res[4] = 4
+			binary.BigEndian.PutUint32(res[8:12], uint32(4+len(key)+len(val)))
+			binary.BigEndian.PutUint64(res[16:24], 1)
+			res = append(res, 0, 0, 0, 0)
+			res = append(res, key...)
+			res = append(res, val...)
+			quiet = append(quiet, res)
+		case opGetK:
+			val, ok := items[key]
+			if !ok {
+				binary.BigEndian.PutUint16(res[6:8], statusKeyEnoent)
+				w.Write(res)
+			} else {
+				if echo, ok := items["echo:"+key]; ok {
+					key = echo // misroute to another key
+				}
+				binary.BigEndian.PutUint16(res[2:4], uint16(len(key)))
+				res[4] = 4
+				binary.BigEndian.PutUint32(res[8:12], uint32(4+len(key)+len(val)))
+				binary.BigEndian.PutUint64(res[16:24], 1)
+				w.Write(res)
+				w.Write([]byte{0, 0, 0, 0})
+				w.WriteString(key)
+				w.WriteString(val)
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		case opSet:
+			items[key] = string(body[extraLen+keyLen:])
+			binary.BigEndian.PutUint64(res[16:24], 42)
+			w.Write(res)
+			if err := w.Flush(); err != nil {
+				return
+			}
+		case opDelete:
+			status, msg := statusSuccess, ""
+			if _, ok := items[key]; !ok {
+				status, msg = statusKeyEnoent, "Not found"
+			} else if cas := binary.BigEndian.Uint64(hdr[16:24]); cas != 0 && cas != 1 {
+				status, msg = statusKeyExists, "Data exists for key."
+			} else {
+				delete(items, key)
+			}
+			binary.BigEndian.PutUint16(res[6:8], status)
+			binary.BigEndian.PutUint32(res[8:12], uint32(len(msg)))
+			w.Write(res)
+			w.WriteString(msg)
+			if err := w.Flush(); err != nil {
+				return
+			}
+		case opNoop:
+			for i := len(quiet) - 1; i >= 0; i-- {
+				w.Write(quiet[i])
+			}
+			quiet = nil
+			w.Write(res)
+			if err := w.Flush(); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestDeleteCAS(t *testing.T) {
+	c := New(binaryServer(t, map[string]string{"a": "1", "b": "2"}))
+	c.Binary = true
+	c.MaxIdleConns = 1
+	assert.Equal(t, ErrNoCasID, c.DeleteCAS("a", 0))
+	assert.Equal(t, ErrCASConflict, c.DeleteCAS("a", 2))
+	assert.NoError(t, c.DeleteCAS("a", 1))
+	assert.Equal(t, ErrCacheMiss, c.DeleteCAS("a", 1))
+	it, err := c.Get("b")
+	assert.NoError(t, err, "error responses are read in full")
+	assert.Equal(t, "2", string(it.Value))
+
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		switch line {
+		case "md a C1":
+			rw.WriteString("HD\r\n")
+		case "md a C2":
+			rw.WriteString("EX\r\n")
+		default:
+			rw.WriteString("NF\r\n")
+		}
+	})
+	c = New(addr)
+	assert.Equal(t, ErrNoCasID, c.DeleteCAS("a", 0))
+	assert.NoError(t, c.DeleteCAS("a", 1))
+	assert.Equal(t, ErrCASConflict, c.DeleteCAS("a", 2))
+	assert.Equal(t, ErrCacheMiss, c.DeleteCAS("b", 1))
+	assert.Equal(t, []string{"md a C1", "md a C2", "md b C1"}, lines)
+}
+
+func TestBinaryGetMultiBatches(t *testing.T) {
+	items := map[string]string{"a": "1", "c": "3", "d": "4", "f": "6"}
+	addr := binaryServer(t, items)
+	c := New(addr)
+	c.Binary = true
+	c.BinaryBatchSize = 2
+	m, err := c.GetMulti([]string{"a", "b", "c", "d", "e", "f", "g"})
+	assert.NoError(t, err)
+	assert.Len(t, m, len(items))
+	for key, val := range items {
+		if assert.Contains(t, m, key) {
+			assert.Equal(t, []byte(val), m[key].Value)
+		}
+	}
+	// the connection is left in a clean state and reused
+	assert.Len(t, c.freeconn[addr], 1)
+}
+
+func TestAppendKeepsFlags(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("b"), Flags: 7}))
+	assert.NoError(t, c.Append(&Item{Key: "foo", Value: []byte("c"), Flags: 9, Expiration: 60}))
+	assert.NoError(t, c.Prepend(&Item{Key: "foo", Value: []byte("a"), Flags: 9}))
+	it, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), it.Value)
+	assert.Equal(t, uint32(7), it.Flags)
+
+	// the ignored flags and expiration aren't sent
+	var buf bytes.Buffer
+	rw := bufio.NewReadWriter(bufio.NewReader(&buf), bufio.NewWriter(&buf))
+	assert.NoError(t, c.writeItem(rw, "append", &Item{Key: "foo", Value: []byte("c"), Flags: 9, Expiration: 60}))
+	assert.NoError(t, rw.Flush())
+	assert.Equal(t, "append foo 0 0 1\r\nc\r\n", buf.String())
+}
+
+func TestEmptyValue(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.Set(&Item{Key: "empty", Value: []byte{}}))
+	it, err := c.Get("empty")
+	assert.NoError(t, err)
+	assert.NotNil(t, it.Value)
+	assert.Len(t, it.Value, 0)
+
+	_, err = c.Get("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+
+	m, err := c.GetMulti([]string{"empty", "missing"})
+	assert.NoError(t, err)
+	if assert.Contains(t, m, "empty") {
+		assert.Equal(t, []byte{}, m["empty"].Value)
+	}
+	assert.Len(t, m, 1)
+}
+
+func TestBinaryEmptyValue(t *testing.T) {
+	c := New(binaryServer(t, map[string]string{}))
+	c.Binary = true
+	assert.NoError(t, c.Set(&Item{Key: "empty", Value: []byte{}}))
+	it, err := c.Get("empty")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, it.Value)
+
+	_, err = c.Get("missing")
+	assert.True(t, errors.Is(err, ErrCacheMiss), "a miss differs from an empty hit")
+
+	m, err := c.GetMulti([]string{"empty", "missing"})
+	assert.NoError(t, err)
+	if assert.Contains(t, m, "empty") {
+		assert.Equal(t, []byte{}, m["empty"].Value)
+	}
+	assert.Len(t, m, 1)
+}
+
+func TestCompareAndSwapCasID(t *testing.T) {
+	var cas uint64 = 7
+	c := New(fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		f := strings.Fields(line)
+		if f[0] != "cas" {
+			return
+		}
+		var n int
+		var id uint64
+		fmt.Sscanf(f[4], "%d", &n)
+		fmt.Sscanf(f[5], "%d", &id)
+		io.ReadFull(rw, make([]byte, n+2))
+		if id != atomic.LoadUint64(&cas) {
+			fmt.Fprintf(rw, "EXISTS\r\n")
+			return
+		}
+		atomic.AddUint64(&cas, 1)
+		fmt.Fprintf(rw, "STORED\r\n")
+	}))
+
+	// a CasID passed along from elsewhere, not from a Get of this client
+	assert.NoError(t, c.CompareAndSwap(&Item{Key: "foo", Value: []byte("v1"), CasID: 7}))
+	assert.Equal(t, ErrCASConflict, c.CompareAndSwap(&Item{Key: "foo", Value: []byte("v2"), CasID: 7}))
+	assert.Equal(t, ErrNoCasID, c.CompareAndSwap(&Item{Key: "foo", Value: []byte("v3")}))
+}
+
+func TestLookup(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	it, ok, err := c.Lookup("foo")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("bar"), it.Value)
+
+	it, ok, err = c.Lookup("missing")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, it)
+
+	_, ok, err = c.Lookup("bad key")
+	assert.ErrorIs(t, err, ErrMalformedKey)
+	assert.False(t, ok)
+}
+
+func TestWrapMissWithKey(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	_, err := c.Get("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+
+	c.WrapMissWithKey = true
+	_, err = c.Get("missing")
+	assert.ErrorIs(t, err, ErrCacheMiss)
+	var me *CacheMissError
+	if assert.True(t, errors.As(err, &me)) {
+		assert.Equal(t, "missing", me.Key)
+	}
+	assert.Equal(t, `memcache: cache miss for key "missing"`, err.Error())
+
+	_, ok, err := c.Lookup("missing")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestOnUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := ln.Addr().String()
+	ln.Close()
+
+	var consulted []string
+	fallback := func(op, key string) ([]byte, bool) {
+		consulted = append(consulted, op+" "+key)
+		return []byte("default"), key == "foo"
+	}
+	c := New(down)
+	c.OnUnavailable = fallback
+	it, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("default"), it.Value)
+	_, err = c.Get("bar")
+	var de *DialError
+	assert.True(t, errors.As(err, &de), err)
+
+	// misses aren't outages
+	up, _ := memoryServer(t, -1)
+	c = New(up)
+	c.OnUnavailable = fallback
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Equal(t, []string{"get foo", "get bar"}, consulted)
+}
+func TestValidateKey(t *testing.T) {
+	c := New("127.0.0.1:11211")
+	assert.NoError(t, c.ValidateKey("foo"))
+
+	err := c.ValidateKey(strings.Repeat("k", 251))
+	assert.ErrorIs(t, err, ErrMalformedKey)
+	assert.Contains(t, err.Error(), "251 bytes long")
+
+	err = c.ValidateKey("foo bar")
+	assert.ErrorIs(t, err, ErrMalformedKey)
+	assert.Contains(t, err.Error(), "illegal byte 0x20 at position 3")
+
+	err = c.ValidateKey("foo\x7f")
+	assert.ErrorIs(t, err, ErrMalformedKey)
+	assert.Contains(t, err.Error(), "illegal byte 0x7f at position 3")
+
+	// any byte goes in binary keys
+	c.Binary = true
+	assert.NoError(t, c.ValidateKey("foo bar"))
+}
+
+func TestRename(t *testing.T) {
+	addr, stored := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.Set(&Item{Key: "old", Value: []byte("v"), Flags: 3}))
+	assert.NoError(t, c.Set(&Item{Key: "taken", Value: []byte("t")}))
+
+	assert.Equal(t, ErrNotStored, c.Rename("old", "taken"))
+	assert.Equal(t, "t", stored("taken"))
+	assert.Equal(t, "v", stored("old"))
+
+	assert.NoError(t, c.Rename("old", "new"))
+	it, err := c.Get("new")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), it.Value)
+	assert.Equal(t, uint32(3), it.Flags)
+	_, err = c.Get("old")
+	assert.Equal(t, ErrCacheMiss, err)
+
+	assert.Equal(t, ErrCacheMiss, c.Rename("old", "other"))
+}
+
+func TestGetCounter(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.Set(&Item{Key: "n", Value: []byte("42")}))
+	// decr leaves the value's length as is, padding it with spaces
+	assert.NoError(t, c.Set(&Item{Key: "padded", Value: []byte("9 ")}))
+	assert.NoError(t, c.Set(&Item{Key: "text", Value: []byte("abc")}))
+
+	n, err := c.GetCounter("n")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), n)
+	n, err = c.GetCounter("padded")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(9), n)
+	_, err = c.GetCounter("text")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `"text" isn't a counter`)
+	_, err = c.GetCounter("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestOnKeyAccess(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	var mu sync.Mutex
+	var accessed []string
+	c.OnKeyAccess = func(op, key string) {
+		mu.Lock()
+		defer mu.Unlock()
+		accessed = append(accessed, op+" "+key)
+	}
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	_, err := c.Get("foo")
+	assert.NoError(t, err)
+	_, err = c.GetMulti([]string{"a", "b"})
+	assert.NoError(t, err)
+	_, err = c.MetaGet("foo", MetaFlags{ReturnValue: true})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Delete("foo"))
+	assert.NoError(t, c.SetMulti([]*Item{{Key: "x", Value: []byte("1")}, {Key: "y", Value: []byte("2")}}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"set foo", "get foo", "get a", "get b", "mg foo", "delete foo", "set x", "set y"}, accessed)
+}
+
+func TestSizeOf(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("hello")}))
+	n, err := c.SizeOf("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = c.SizeOf("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestExpirationPolicy(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	tooLarge := &Item{Key: "foo", Value: []byte("bar"), Expiration: MaxRelativeExpiration + 1}
+	assert.NoError(t, c.Set(tooLarge))
+
+	c.ExpirationPolicy = ExpirationRelativeSeconds
+	assert.Equal(t, ErrExpirationTooLarge, c.Set(tooLarge))
+	assert.Equal(t, ErrExpirationTooLarge, c.SetMulti([]*Item{tooLarge}))
+	_, err := c.SetMeta(tooLarge, MetaFlags{})
+	assert.Equal(t, ErrExpirationTooLarge, err)
+	assert.Equal(t, ErrExpirationTooLarge, c.Touch("foo", MaxRelativeExpiration+1))
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar"), Expiration: MaxRelativeExpiration}))
+}
+
+func TestMaxOpenConns(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	c.MaxOpenConns = 1
+	c.AcquirePoolTimeout = 20 * time.Millisecond
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar")}))
+
+	// a session pins the only connection allowed
+	s := c.Session()
+	_, err := s.Get("foo")
+	assert.NoError(t, err)
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrPoolTimeout, err)
+
+	c.AcquirePoolTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	naddr, err := resolveAddr(addr)
+	assert.NoError(t, err)
+	_, err = c.getConnContext(ctx, naddr)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.NoError(t, s.Close())
+	_, err = c.Get("foo")
+	assert.NoError(t, err)
+
+	stats := c.PoolStats()
+	assert.Equal(t, uint64(2), stats.Waits)
+	assert.Equal(t, uint64(1), stats.Timeouts)
+	assert.True(t, stats.WaitDuration >= 40*time.Millisecond)
+}
+
+func TestPoolWaitDurationClock(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	c.MaxOpenConns = 1
+	c.AcquirePoolTimeout = time.Millisecond
+	var mu sync.Mutex
+	now := time.Now()
+	c.now = func() time.Time {
+		// every reading of the clock is a minute later
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Minute)
+		return now
+	}
+	s := c.Session()
+	defer s.Close()
+	_, err := s.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrPoolTimeout, err)
+	assert.Equal(t, time.Minute, c.PoolStats().WaitDuration)
+}
+
+func TestIdleStats(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	c.MaxIdleConns = 2
+	// each session holds its own connection until closed
+	var sessions []*Session
+	for i := 0; i < 3; i++ {
+		s := c.Session()
+		assert.NoError(t, s.Set(&Item{Key: "foo", Value: []byte("bar")}))
+		sessions = append(sessions, s)
+	}
+	for _, s := range sessions {
+		assert.NoError(t, s.Close())
+	}
+	assert.Equal(t, map[string]IdleStats{
+		addr: {MaxIdleSeen: 2, IdleEvictions: 1},
+	}, c.PoolStats().Idle)
+}
+
+func TestMaxIdleConnsFor(t *testing.T) {
+	big, _ := memoryServer(t, -1)
+	small, _ := memoryServer(t, -1)
+	var ss ServerList
+	assert.NoError(t, ss.SetServers(big, small))
+	c := NewFromSelector(&ss)
+	c.MaxIdleConns = 1
+	c.MaxIdleConnsFor = func(addr net.Addr) int {
+		if addr.String() == big {
+			return 3
+		}
+		return 0
+	}
+	for _, addr := range []string{big, small} {
+		addr, err := resolveAddr(addr)
+		assert.NoError(t, err)
+		var conns []*conn
+		for i := 0; i < 4; i++ {
+			cn, err := c.getConn(addr)
+			assert.NoError(t, err)
+			conns = append(conns, cn)
+		}
+		for _, cn := range conns {
+			cn.release()
+		}
+	}
+	assert.Equal(t, map[string]IdleStats{
+		big:   {MaxIdleSeen: 3, IdleEvictions: 1},
+		small: {MaxIdleSeen: 1, IdleEvictions: 3},
+	}, c.PoolStats().Idle)
+}
+
+func TestGetMultiFunc(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, c.Set(&Item{Key: key, Value: []byte(key)}))
+	}
+	var got []string
+	err := c.GetMultiFunc([]string{"a", "missing", "b", "c"}, func(it *Item) error {
+		got = append(got, string(it.Value))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, got)
+	assert.Len(t, c.freeconn[addr], 1)
+
+	stop := errors.New("stop")
+	got = nil
+	err = c.GetMultiFunc([]string{"a", "b", "c"}, func(it *Item) error {
+		got = append(got, it.Key)
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []string{"a"}, got)
+	// the connection was left mid-response, so it isn't reused
+	assert.Empty(t, c.freeconn[addr])
+}
+
+func TestGetMultiStream(t *testing.T) {
+	stall := make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		// the first item arrives, then the server stalls
+		fmt.Fprintf(rw, "VALUE a 0 1 1\r\na\r\n")
+		rw.Flush()
+		<-stall
+	})
+	c := New(addr)
+	c.Timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	var got []string
+	err := c.GetMultiStream(ctx, []string{"a", "b"}, func(it *Item) error {
+		got = append(got, it.Key)
+		cancel()
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"a"}, got)
+}
+
+func TestMaxMultiGetBytes(t *testing.T) {
+	stall := make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		// three 10 byte values arrive, then the server stalls
+		for _, key := range []string{"a", "b", "c"} {
+			fmt.Fprintf(rw, "VALUE %s 0 10 1\r\n0123456789\r\n", key)
+		}
+		if strings.Contains(line, " d") {
+			rw.Flush()
+			<-stall
+		}
+		rw.WriteString("END\r\n")
+	})
+	c := New(addr)
+	c.Timeout = time.Minute
+	c.MaxMultiGetBytes = 30
+	m, err := c.GetMulti([]string{"a", "b", "c"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 3)
+
+	c.MaxMultiGetBytes = 25
+	m, err = c.GetMulti([]string{"a", "b", "c", "d"})
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Nil(t, m)
+	m, err = c.GetMultiContext(context.Background(), []string{"a", "b", "c", "d"})
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Nil(t, m)
+	m, err = c.NewSelectionCache([]string{"a", "b", "c", "d"}).GetMulti()
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Nil(t, m)
+}
+
+func TestMaxMultiGetBytesDeclaredSize(t *testing.T) {
+	stall := make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		// a value of 1GB is declared, but never sent
+		fmt.Fprintf(rw, "VALUE a 0 1073741824 1\r\n")
+		rw.Flush()
+		<-stall
+	})
+	c := New(addr)
+	c.Timeout = time.Minute
+	c.MaxMultiGetBytes = 1 << 20
+	m, err := c.GetMulti([]string{"a"})
+	assert.Equal(t, ErrResponseTooLarge, err, "failed before reading the value")
+	assert.Nil(t, m)
+
+	c = New(binaryServer(t, map[string]string{"a": "0123456789", "b": "0123456789"}))
+	c.Binary = true
+	c.MaxMultiGetBytes = 15
+	m, err = c.GetMulti([]string{"a", "b"})
+	assert.Equal(t, ErrResponseTooLarge, err, "binary")
+	assert.Nil(t, m)
+}
+
+func TestValidateValue(t *testing.T) {
+	addr, stored := memoryServer(t, -1)
+	c := New(addr)
+	errInvalid := errors.New("invalid UTF-8")
+	c.ValidateValue = func(value []byte) error {
+		if !utf8.Valid(value) {
+			return errInvalid
+		}
+		return nil
+	}
+	bad := &Item{Key: "bad", Value: []byte{0xff}}
+	assert.Equal(t, errInvalid, c.Set(bad))
+	assert.Equal(t, errInvalid, c.Add(bad))
+	assert.Equal(t, errInvalid, c.SetMulti([]*Item{{Key: "good", Value: []byte("ok")}, bad}))
+	assert.Equal(t, errInvalid, c.Session().Set(bad))
+	assert.Empty(t, stored("good"))
+	assert.NoError(t, c.Set(&Item{Key: "good", Value: []byte("ok")}))
+	assert.Equal(t, "ok", stored("good"))
+}
+
+func TestMaxValueSize(t *testing.T) {
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		f := strings.Fields(line)
+		switch f[0] {
+		case "stats":
+			fmt.Fprintf(rw, "STAT maxbytes 67108864\r\nSTAT item_size_max 8\r\nEND\r\n")
+		case "set":
+			var n int
+			fmt.Sscanf(f[4], "%d", &n)
+			io.ReadFull(rw, make([]byte, n+2))
+			fmt.Fprintf(rw, "STORED\r\n")
+		}
+	})
+	c := New(addr)
+	c.MaxValueSize = 4
+	assert.Equal(t, ErrValueTooLarge, c.Set(&Item{Key: "foo", Value: []byte("too big")}))
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("ok")}))
+	assert.Equal(t, []string{"set foo 0 0 2"}, lines)
+
+	// the server's limit replaces MaxValueSize once found
+	lines = nil
+	c = New(addr)
+	c.MaxValueSize = 4
+	c.AutoDetectLimits = true
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("big")}))
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bigger")}))
+	assert.Equal(t, ErrValueTooLarge, c.Set(&Item{Key: "foo", Value: []byte("too big!!")}))
+	assert.Equal(t, []string{"stats settings", "set foo 0 0 3", "set foo 0 0 6"}, lines)
+}
+
+func TestMaxValueSizePerServer(t *testing.T) {
+	var mu sync.Mutex
+	sets := make(map[string][]string)
+	conns := make(map[*bufio.ReadWriter]bool)
+	limitServer := func(limit int) string {
+		var addr string
+		addr = fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+			mu.Lock()
+			conns[rw] = true
+			mu.Unlock()
+			f := strings.Fields(line)
+			switch f[0] {
+			case "stats":
+				fmt.Fprintf(rw, "STAT item_size_max %d\r\nEND\r\n", limit)
+			case "set":
+				var n int
+				fmt.Sscanf(f[4], "%d", &n)
+				io.ReadFull(rw, make([]byte, n+2))
+				mu.Lock()
+				sets[addr] = append(sets[addr], f[1])
+				mu.Unlock()
+				fmt.Fprintf(rw, "STORED\r\n")
+			}
+		})
+		return addr
+	}
+	small, big := limitServer(8), limitServer(64)
+	c := New(small, big)
+	c.AutoDetectLimits = true
+	var smallKeys []string
+	for i := 0; len(smallKeys) < 2; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if addr, _ := c.selector.PickServer(key); addr.String() == small {
+			smallKeys = append(smallKeys, key)
+		}
+	}
+	bigKey := keyFor(t, c.selector, big)
+	value := []byte("more than eight bytes")
+
+	// the limit found on the first connection already applies
+	assert.Equal(t, ErrValueTooLarge, c.Set(&Item{Key: smallKeys[0], Value: value}))
+	assert.NoError(t, c.Set(&Item{Key: bigKey, Value: value}), "only the small server's limit is exceeded")
+	assert.Equal(t, ErrValueTooLarge, c.Set(&Item{Key: smallKeys[0], Value: value}))
+
+	err := c.SetMulti([]*Item{
+		{Key: smallKeys[0], Value: value},
+		{Key: smallKeys[1], Value: []byte("ok")},
+		{Key: bigKey, Value: value},
+	})
+	assert.Equal(t, ErrValueTooLarge, err)
+	assert.Equal(t, map[string][]string{small: {smallKeys[1]}, big: {bigKey, bigKey}}, sets)
+	assert.Len(t, conns, 2, "one connection to each server, kept after rejections")
+
+	// oversize values are rejected before dialing
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := ln.Addr().String()
+	ln.Close()
+	c = New(down)
+	c.MaxValueSize = 8
+	assert.Equal(t, ErrValueTooLarge, c.Set(&Item{Key: "foo", Value: value}))
+	assert.Equal(t, ErrValueTooLarge, c.SetMulti([]*Item{{Key: "foo", Value: value}}))
+}
+
+func TestBinaryGetMultiOpaque(t *testing.T) {
+	items := map[string]string{"hit1": "1", "hit2": "2", "hit3": "3"}
+	c := New(binaryServer(t, items))
+	c.Binary = true
+	keys := []string{"miss1", "hit1", "miss2", "hit2", "hit3", "miss3"}
+	m, err := c.GetMulti(keys)
+	assert.NoError(t, err)
+	assert.Len(t, m, len(items))
+	for key, val := range items {
+		if assert.Contains(t, m, key) {
+			assert.Equal(t, key, m[key].Key)
+			assert.Equal(t, []byte(val), m[key].Value)
+		}
+	}
+}
+
+func TestBinaryGetK(t *testing.T) {
+	items := map[string]string{"foo": "1", "bar": "2", "echo:bar": "baz"}
+	addr := binaryServer(t, items)
+	c := New(addr)
+	c.Binary = true
+	it, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", it.Key)
+	assert.Equal(t, []byte("1"), it.Value)
+
+	// a miss keeps the connection
+	_, err = c.Get("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Len(t, c.freeconn[addr], 1)
+
+	// the server answers for bar with baz's key
+	_, err = c.Get("bar")
+	assert.Equal(t, ErrProtocol, err)
+}
+
+func TestBinarySetCasID(t *testing.T) {
+	c := New(binaryServer(t, map[string]string{}))
+	c.Binary = true
+	item := &Item{Key: "foo", Value: []byte("bar")}
+	assert.NoError(t, c.Set(item))
+	assert.Equal(t, uint64(42), item.CasID)
+}
+
+func TestDialer(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	var dialed []string
+	c.Dialer = &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Control: func(network, address string, _ syscall.RawConn) error {
+			dialed = append(dialed, address)
+			return nil
+		},
+	}
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	assert.Equal(t, []string{addr}, dialed)
+	cn := c.freeconn[addr][0]
+	assert.True(t, cn.nc.LocalAddr().(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)))
+}
+
+func TestReset(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	// a session's connection is in flight across the reset
+	s := c.Session()
+	assert.NoError(t, s.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	inFlight := s.conns[addr]
+
+	_, err := c.Get("foo")
+	assert.NoError(t, err)
+	idle := c.freeconn[addr][0]
+	assert.False(t, idle == inFlight)
+
+	c.Reset()
+	assert.Empty(t, c.freeconn)
+	_, err = idle.nc.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+
+	_, err = s.Get("foo")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+	assert.Empty(t, c.freeconn[addr])
+	_, err = inFlight.nc.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+
+	_, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.Len(t, c.freeconn[addr], 1)
+}
+
+func TestClone(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	idle := c.freeconn[addr][0]
+
+	c2 := c.Clone()
+	c2.Timeout = time.Second
+	assert.Zero(t, c.Timeout)
+	it, err := c2.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), it.Value)
+	// the clone reused the connection pooled by c
+	assert.Equal(t, []*conn{idle}, c.freeconn[addr])
+	assert.True(t, idle.c == c2)
+}
+
+func TestValidateIdleAfter(t *testing.T) {
+	var versions int32
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if line == "version" {
+			atomic.AddInt32(&versions, 1)
+			fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+			return
+		}
+		fmt.Fprintf(rw, "END\r\n")
+	})
+	// the fake clock needn't be near real time
+	now := time.Unix(0, 0)
+	c := New(addr)
+	c.now = func() time.Time { return now }
+	c.ValidateIdleAfter = time.Minute
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+
+	// recently used connections aren't pinged
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&versions))
+
+	// an idle connection is pinged and kept
+	now = now.Add(2 * time.Minute)
+	idle := c.freeconn[addr][0]
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&versions))
+	assert.Equal(t, []*conn{idle}, c.freeconn[addr])
+
+	// one that was closed while idle is replaced
+	now = now.Add(2 * time.Minute)
+	idle.nc.Close()
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Len(t, c.freeconn[addr], 1)
+	assert.False(t, c.freeconn[addr][0] == idle)
+}
+
+func TestRetries(t *testing.T) {
+	var dials int
+	c := NewFromConnFunc(func() (net.Conn, error) {
+		// every other dial fails
+		dials++
+		if dials%2 == 1 {
+			return nil, errors.New("refused")
+		}
+		client, server := net.Pipe()
+		go serveFake(server, func(line string, rw *bufio.ReadWriter) {
+			if line == "gets foo" {
+				fmt.Fprintf(rw, "VALUE foo 0 3 1\r\nbar\r\n")
+			}
+			fmt.Fprintf(rw, "END\r\n")
+		})
+		return client, nil
+	})
+	c.MaxRetries = 1
+	it, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), it.Value)
+	assert.Equal(t, 2, dials)
+
+	// misses aren't retried, and RetryIf can refuse everything
+	var retried []error
+	c.RetryIf = func(err error) bool {
+		retried = append(retried, err)
+		return false
+	}
+	_, err = c.Get("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+	c.Reset()
+	_, err = c.Get("foo")
+	var de *DialError
+	assert.True(t, errors.As(err, &de), err)
+	assert.Len(t, retried, 1)
+	assert.Equal(t, 3, dials)
+	assert.False(t, DefaultRetryIf(ErrCacheMiss))
+	assert.False(t, DefaultRetryIf(ErrNotStored))
+}
+
+func TestDisablePooling(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	c.DisablePooling = true
+	var dialed int
+	c.Dialer = &net.Dialer{Control: func(string, string, syscall.RawConn) error {
+		dialed++
+		return nil
+	}}
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	_, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dialed)
+	assert.Empty(t, c.freeconn[addr])
+}
+
+func TestMixedProtocols(t *testing.T) {
+	text, _ := memoryServer(t, -1)
+	bin := binaryServer(t, map[string]string{})
+	var ss ServerList
+	assert.NoError(t, ss.SetServers(text, bin))
+	assert.NoError(t, ss.SetBinaryServers(bin))
+	c := NewFromSelector(&ss)
+	textKey, binKey := keyFor(t, &ss, text), keyFor(t, &ss, bin)
+
+	for _, key := range []string{textKey, binKey} {
+		assert.NoError(t, c.Set(&Item{Key: key, Value: []byte("v-" + key)}))
+		it, err := c.Get(key)
+		if assert.NoError(t, err, key) {
+			assert.Equal(t, []byte("v-"+key), it.Value)
+		}
+	}
+	m, err := c.GetMulti([]string{textKey, binKey})
+	assert.NoError(t, err)
+	assert.Len(t, m, 2)
+
+	// text only commands fail for the binary server only
+	assert.Equal(t, ErrUnsupported, c.Touch(binKey, 10))
+	assert.NotEqual(t, ErrUnsupported, c.Touch(textKey, 10))
+}
+
+// TestWriteTimeout checks that a connection whose writes block until they
+// time out is discarded after every kind of command, in both protocols.
+func TestWriteTimeout(t *testing.T) {
+	ops := map[string]func(c *Client) error{
+		"get": func(c *Client) error {
+			_, err := c.Get("foo")
+			return err
+		},
+		"getmulti": func(c *Client) error {
+			_, err := c.GetMulti([]string{"foo", "bar"})
+			return err
+		},
+		"set": func(c *Client) error {
+			return c.Set(&Item{Key: "foo", Value: []byte("bar")})
+		},
+		"add": func(c *Client) error {
+			return c.Add(&Item{Key: "foo", Value: []byte("bar")})
+		},
+		"cas": func(c *Client) error {
+			return c.CompareAndSwap(&Item{Key: "foo", Value: []byte("bar"), CasID: 1})
+		},
+		"delete": func(c *Client) error {
+			return c.Delete("foo")
+		},
+		"touch": func(c *Client) error {
+			return c.Touch("foo", 10)
+		},
+		"incr": func(c *Client) error {
+			_, err := c.Increment("foo", 1)
+			return err
+		},
+		"mg": func(c *Client) error {
+			_, err := c.MetaGet("foo", MetaFlags{ReturnValue: true})
+			return err
+		},
+	}
+	binaryOps := []string{"get", "getmulti", "set"}
+	for name, op := range ops {
+		for _, binary := range []bool{false, true} {
+			if binary && !containsString(binaryOps, name) {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s/binary=%v", name, binary), func(t *testing.T) {
+				c := New("127.0.0.1:11211")
+				c.Binary = binary
+				c.Timeout = 20 * time.Millisecond
+				addr, err := c.selector.PickServer("foo")
+				assert.NoError(t, err)
+				// nothing reads the other end of the pipe, so writes block
+				client, server := net.Pipe()
+				defer server.Close()
+				cn := &conn{nc: client, addr: addr, c: c}
+				cn.rw = bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(connWriter{cn}))
+				c.putFreeConn(addr, cn)
+
+				err = op(c)
+				var we *WriteError
+				assert.True(t, errors.As(err, &we), err)
+				assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), err)
+				assert.Empty(t, c.freeconn[addr.String()])
+				_, err = client.Write([]byte("x"))
+				assert.ErrorIs(t, err, io.ErrClosedPipe)
+			})
+		}
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
 func TestConnectionClosing(t *testing.T) {
 	ln, err := net.Listen("tcp", ":0")
 	assert.NoError(t, err)
@@ -336,3 +1617,708 @@ func TestConnectionClosing(t *testing.T) {
 	_, err = c.Get("key")
 	assert.Empty(t, c.freeconn)
 }
+
+// keyFor returns a key that ss places on addr
+func keyFor(t *testing.T, ss ServerSelector, addr string) string {
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		a, err := ss.PickServer(key)
+		assert.NoError(t, err)
+		if a.String() == addr {
+			return key
+		}
+	}
+	t.Fatalf("no key found for %s", addr)
+	return ""
+}
+
+func TestGetMultiStrict(t *testing.T) {
+	good := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		key := strings.Fields(line)[1]
+		fmt.Fprintf(rw, "VALUE %s 0 3 1\r\nval\r\nEND\r\n", key)
+	})
+	bad := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "SERVER_ERROR busy\r\n")
+	})
+	c := New(good, bad)
+	keys := []string{keyFor(t, c.selector, good), keyFor(t, c.selector, bad)}
+
+	m, err := c.GetMulti(keys)
+	assert.Error(t, err)
+	assert.Len(t, m, 1)
+
+	m, err = c.GetMultiStrict(keys)
+	assert.Error(t, err)
+	assert.Nil(t, m)
+}
+
+func TestGetMultiOnError(t *testing.T) {
+	good := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		key := strings.Fields(line)[1]
+		fmt.Fprintf(rw, "VALUE %s 0 3 1\r\nval\r\nEND\r\n", key)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := ln.Addr().String()
+	ln.Close()
+	c := New(good, down)
+	goodKey, downKey := keyFor(t, c.selector, good), keyFor(t, c.selector, down)
+	keys := []string{goodKey, downKey}
+
+	c.GetMultiOnError = GetMultiSkip
+	var skipped []string
+	c.OnGetMultiSkip = func(addr net.Addr, keys []string, err error) {
+		assert.Equal(t, down, addr.String())
+		assert.Error(t, err)
+		skipped = append(skipped, keys...)
+	}
+	m, err := c.GetMulti(keys)
+	assert.NoError(t, err)
+	assert.Len(t, m, 1)
+	assert.Contains(t, m, goodKey)
+	assert.Equal(t, []string{downKey}, skipped)
+
+	m, err = c.GetMultiStrict(keys)
+	assert.Error(t, err, "strict despite GetMultiSkip")
+	assert.Nil(t, m)
+
+	c.GetMultiOnError = GetMultiFail
+	m, err = c.GetMulti(keys)
+	assert.Error(t, err)
+	assert.Nil(t, m)
+}
+
+func TestGetMultiContextPartial(t *testing.T) {
+	fast := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		key := strings.Fields(line)[1]
+		fmt.Fprintf(rw, "VALUE %s 0 3 1\r\nval\r\nEND\r\n", key)
+	})
+	unblock := make(chan struct{})
+	defer close(unblock)
+	slow := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		<-unblock
+	})
+	c := New(fast, slow)
+	c.Timeout = 5 * time.Second
+	fastKey, slowKey := keyFor(t, c.selector, fast), keyFor(t, c.selector, slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	m, err := c.GetMultiContext(ctx, []string{fastKey, slowKey})
+	assert.Equal(t, ErrPartialResult, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Len(t, m, 1)
+	assert.Contains(t, m, fastKey)
+
+	// the slow server's connection is closed rather than pooled
+	time.Sleep(50 * time.Millisecond)
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for addr, free := range c.freeconn {
+		if addr == slow {
+			assert.Empty(t, free)
+		}
+	}
+}
+
+func TestGetMultiShardTimeout(t *testing.T) {
+	fast := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		key := strings.Fields(line)[1]
+		fmt.Fprintf(rw, "VALUE %s 0 3 1\r\nval\r\nEND\r\n", key)
+	})
+	unblock := make(chan struct{})
+	defer close(unblock)
+	slow := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		<-unblock
+	})
+	c := New(fast, slow)
+	c.Timeout = 5 * time.Second
+	fastKey, slowKey := keyFor(t, c.selector, fast), keyFor(t, c.selector, slow)
+
+	start := time.Now()
+	m, err := c.GetMultiContext(context.Background(), []string{fastKey, slowKey}, WithShardTimeout(50*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Len(t, m, 1)
+	assert.Contains(t, m, fastKey)
+	var se ServerErrors
+	if assert.True(t, errors.As(err, &se), err) && assert.Len(t, se, 1) {
+		for addr, err := range se {
+			assert.Equal(t, slow, addr.String())
+			assert.Equal(t, context.DeadlineExceeded, err)
+		}
+	}
+	// the server's error is seen through ServerErrors
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestSocketBufferSizes(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "END\r\n")
+	})
+	c := New(addr)
+	c.SendBufferSize = 1 << 20
+	c.RecvBufferSize = 1 << 20
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestCloseOnError(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		f := strings.Fields(line)
+		if f[0] == "add" {
+			io.ReadFull(rw, make([]byte, 5))
+			fmt.Fprintf(rw, "NOT_STORED\r\n")
+		} else {
+			fmt.Fprintf(rw, "END\r\n")
+		}
+	})
+	c := New(addr)
+	assert.Equal(t, ErrNotStored, c.Add(&Item{Key: "foo", Value: []byte("bar")}))
+	assert.Len(t, c.freeconn[addr], 1)
+
+	c = New(addr)
+	c.CloseOnError = true
+	assert.Equal(t, ErrNotStored, c.Add(&Item{Key: "foo", Value: []byte("bar")}))
+	assert.Empty(t, c.freeconn[addr])
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Len(t, c.freeconn[addr], 1)
+}
+
+func TestRawCommand(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if line == "vendor_cmd arg" {
+			fmt.Fprintf(rw, "OK 42\r\n")
+		} else {
+			fmt.Fprintf(rw, "ERROR\r\n")
+		}
+	})
+	c := New(addr)
+	server, err := c.selector.PickServer("")
+	assert.NoError(t, err)
+
+	var reply string
+	err = c.RawCommand(server, []byte("vendor_cmd arg\r\n"), func(r *bufio.Reader) error {
+		line, err := r.ReadString('\n')
+		reply = line
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "OK 42\r\n", reply)
+	assert.Len(t, c.freeconn[addr], 1)
+
+	errBadReply := errors.New("bad reply")
+	err = c.RawCommand(server, []byte("other\r\n"), func(r *bufio.Reader) error {
+		return errBadReply
+	})
+	assert.Equal(t, errBadReply, err)
+	assert.Empty(t, c.freeconn[addr])
+}
+
+func TestClock(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "END\r\n")
+	})
+	c := New(addr)
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+
+	// socket deadlines don't follow the client's clock, whether it's
+	// behind or ahead of real time
+	c.Timeout = 100 * time.Millisecond
+	c.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+
+	stall := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		time.Sleep(time.Second)
+	})
+	c = New(stall)
+	c.Timeout = 100 * time.Millisecond
+	c.now = func() time.Time { return time.Now().Add(time.Hour) }
+	_, err = c.Get("foo")
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Get with a clock ahead: want timeout, got %v", err)
+	}
+}
+
+func TestSetMemLimit(t *testing.T) {
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		fmt.Fprintf(rw, "OK\r\n")
+	})
+	c := New(addr)
+	server, err := c.selector.PickServer("")
+	assert.NoError(t, err)
+	assert.NoError(t, c.SetMemLimit(server, 128))
+	assert.Equal(t, []string{"cache_memlimit 128"}, lines)
+}
+
+func TestCloseServer(t *testing.T) {
+	handler := func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "END\r\n")
+	}
+	addr1, addr2 := fakeServer(t, handler), fakeServer(t, handler)
+	c := New(addr1, addr2)
+	for _, addr := range []string{addr1, addr2} {
+		_, err := c.Get(keyFor(t, c.selector, addr))
+		assert.Equal(t, ErrCacheMiss, err)
+		assert.Len(t, c.freeconn[addr], 1)
+	}
+	assert.NoError(t, c.CloseServer(addr1))
+	assert.Empty(t, c.freeconn[addr1])
+	assert.Len(t, c.freeconn[addr2], 1)
+}
+
+func TestValueIsCopied(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	assert.NoError(t, c.SetMulti([]*Item{
+		{Key: "a", Value: []byte("aaaa")},
+		{Key: "b", Value: []byte("bbbb")},
+	}))
+	first, err := c.Get("a")
+	assert.NoError(t, err)
+	m, err := c.GetMulti([]string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aaaa"), first.Value)
+
+	for i := range first.Value {
+		first.Value[i] = 'x'
+	}
+	again, err := c.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aaaa"), again.Value)
+	assert.Equal(t, []byte("aaaa"), m["a"].Value)
+	assert.Equal(t, []byte("bbbb"), m["b"].Value)
+}
+
+func TestMaxKeysPerRequest(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		for _, key := range strings.Fields(line)[1:] {
+			fmt.Fprintf(rw, "VALUE %s 0 1\r\nv\r\n", key)
+		}
+		fmt.Fprintf(rw, "END\r\n")
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+	})
+	c := New(addr)
+	c.MaxKeysPerRequest = 2
+	m, err := c.GetMulti([]string{"a", "b", "c", "d", "e"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 5)
+	assert.Equal(t, []string{"gets a b", "gets c d", "gets e"}, lines)
+}
+
+func TestFlushServers(t *testing.T) {
+	var mu sync.Mutex
+	flushed := make(map[string]int)
+	handler := func(addr *string) func(string, *bufio.ReadWriter) {
+		return func(line string, rw *bufio.ReadWriter) {
+			mu.Lock()
+			flushed[*addr]++
+			mu.Unlock()
+			fmt.Fprintf(rw, "OK\r\n")
+		}
+	}
+	var addr1, addr2 string
+	addr1, addr2 = fakeServer(t, handler(&addr1)), fakeServer(t, handler(&addr2))
+	c := New(addr1, addr2)
+
+	assert.Error(t, c.FlushServers([]string{addr1, "127.0.0.1:1"}))
+	assert.Empty(t, flushed)
+
+	assert.NoError(t, c.FlushServers([]string{addr2}))
+	assert.Equal(t, map[string]int{addr2: 1}, flushed)
+}
+
+func TestDialErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := New(addr)
+	_, err = c.Get("foo")
+	var de *DialError
+	assert.True(t, errors.As(err, &de), err)
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	err = &ConnectTimeoutError{Addr: ln.Addr()}
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	ne, ok := err.(net.Error)
+	assert.True(t, ok && ne.Timeout())
+}
+
+func TestFailFastWhenNoServers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := ln.Addr().String()
+	ln.Close()
+	up, _ := memoryServer(t, -1)
+
+	now := time.Now()
+	c := New(down, up)
+	c.FailFastWhenNoServers = true
+	c.now = func() time.Time { return now }
+	downKey, upKey := keyFor(t, c.selector, down), keyFor(t, c.selector, up)
+
+	_, err = c.Get(downKey)
+	var de *DialError
+	assert.True(t, errors.As(err, &de), err)
+	// one server is still up, so dials are attempted
+	_, err = c.Get(downKey)
+	assert.True(t, errors.As(err, &de), err)
+	assert.Equal(t, ErrCacheMiss, errorOf(c.Get(upKey)))
+
+	assert.NoError(t, c.selector.(*ServerList).SetServers(down))
+	assert.Equal(t, ErrNoServers, errorOf(c.Get(downKey)))
+
+	// once the retry interval has passed, dialing is tried again
+	now = now.Add(DefaultServerRetryInterval)
+	_, err = c.Get(downKey)
+	assert.True(t, errors.As(err, &de), err)
+}
+
+func errorOf(_ *Item, err error) error { return err }
+
+func TestLatencyProbe(t *testing.T) {
+	up := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if line == "version" {
+			time.Sleep(10 * time.Millisecond)
+			fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+		}
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := ln.Addr().String()
+	ln.Close()
+
+	c := New(up, down)
+	latencies, err := c.LatencyProbe()
+	var se ServerErrors
+	if assert.True(t, errors.As(err, &se), err) {
+		assert.Len(t, se, 1)
+	}
+	assert.Len(t, latencies, 2)
+	for addr, rtt := range latencies {
+		if addr.String() == down {
+			assert.Equal(t, Unreachable, rtt)
+		} else {
+			assert.True(t, rtt >= 10*time.Millisecond, rtt)
+			assert.True(t, rtt < Unreachable)
+		}
+	}
+
+	bc := New(binaryServer(t, nil))
+	bc.Binary = true
+	latencies, err = bc.LatencyProbe()
+	assert.NoError(t, err)
+	assert.Len(t, latencies, 1)
+}
+
+func TestSupportsBinary(t *testing.T) {
+	bin := binaryServer(t, nil)
+	text := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "ERROR\r\n")
+	})
+
+	ok, err := New(bin).SupportsBinary()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = New(bin, text).SupportsBinary()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestNewFromConnFunc(t *testing.T) {
+	var dials int
+	c := NewFromConnFunc(func() (net.Conn, error) {
+		dials++
+		client, server := net.Pipe()
+		go serveFake(server, func(line string, rw *bufio.ReadWriter) {
+			if line == "gets foo" {
+				fmt.Fprintf(rw, "VALUE foo 0 3 1\r\nbar\r\nEND\r\n")
+			} else {
+				fmt.Fprintf(rw, "END\r\n")
+			}
+		})
+		return client, nil
+	})
+	it, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), it.Value)
+	_, err = c.Get("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Equal(t, 1, dials)
+
+	fail := errors.New("no tunnel")
+	c = NewFromConnFunc(func() (net.Conn, error) { return nil, fail })
+	_, err = c.Get("foo")
+	assert.ErrorIs(t, err, fail)
+}
+
+func TestCloseInterruptsInFlight(t *testing.T) {
+	reading, stall := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+	c := NewFromConnFunc(func() (net.Conn, error) {
+		client, server := net.Pipe()
+		// the server reads the command, then stalls
+		go serveFake(server, func(line string, rw *bufio.ReadWriter) {
+			close(reading)
+			<-stall
+		})
+		return client, nil
+	})
+	c.Timeout = time.Minute
+	done := make(chan error)
+	go func() {
+		_, err := c.Get("foo")
+		done <- err
+	}()
+	<-reading
+	assert.NoError(t, c.Close())
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get wasn't interrupted by Close")
+	}
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrClientClosed, err)
+}
+
+func TestDeleteAllParallel(t *testing.T) {
+	var flushes int32
+	release := make(chan struct{})
+	good := func(line string, rw *bufio.ReadWriter) {
+		// all flushes must be in flight at once to be released
+		if atomic.AddInt32(&flushes, 1) == 3 {
+			close(release)
+		}
+		<-release
+		fmt.Fprintf(rw, "OK\r\n")
+	}
+	bad := func(line string, rw *bufio.ReadWriter) {
+		if atomic.AddInt32(&flushes, 1) == 3 {
+			close(release)
+		}
+		<-release
+		fmt.Fprintf(rw, "SERVER_ERROR busy\r\n")
+	}
+	addr1, addr2, addr3 := fakeServer(t, good), fakeServer(t, good), fakeServer(t, bad)
+	c := New(addr1, addr2, addr3)
+	c.Timeout = time.Second
+
+	err := c.DeleteAll()
+	var se ServerErrors
+	if assert.True(t, errors.As(err, &se), err) {
+		assert.Len(t, se, 1)
+		for addr := range se {
+			assert.Equal(t, addr3, addr.String())
+		}
+	}
+}
+
+func TestMisframedValue(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		// the value is one byte longer than announced
+		fmt.Fprintf(rw, "VALUE foo 0 3 1\r\nbarX\r\nEND\r\n")
+	})
+	c := New(addr)
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrProtocol, err)
+	assert.Empty(t, c.freeconn[addr])
+
+	_, err = c.GetMulti([]string{"foo", "bar"})
+	assert.Equal(t, ErrProtocol, err)
+	assert.Empty(t, c.freeconn[addr])
+}
+
+func TestLenientLineEndings(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		f := strings.Fields(line)
+		switch f[0] {
+		case "gets":
+			// a bare "\n" after the value, and "\r\n" elsewhere
+			if f[1] == "mixed" {
+				fmt.Fprintf(rw, "VALUE mixed 0 3 1\r\nbar\nEND\r\n")
+				return
+			}
+			fmt.Fprintf(rw, "VALUE %s 0 3 1\nbar\nEND\n", f[1])
+		case "set":
+			io.ReadFull(rw, make([]byte, 5))
+			fmt.Fprintf(rw, "STORED\n")
+		case "mg":
+			fmt.Fprintf(rw, "VA 3 f0\nbar\n")
+		}
+	})
+
+	strict := New(addr)
+	_, err := strict.Get("foo")
+	assert.Error(t, err)
+	_, err = strict.Get("mixed")
+	assert.Equal(t, ErrProtocol, err)
+	assert.Error(t, strict.Set(&Item{Key: "foo", Value: []byte("bar")}))
+
+	lenient := New(addr)
+	lenient.LenientLineEndings = true
+	for _, key := range []string{"foo", "mixed"} {
+		it, err := lenient.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bar"), it.Value)
+	}
+	m, err := lenient.GetMulti([]string{"foo"})
+	assert.NoError(t, err)
+	assert.Len(t, m, 1)
+	assert.NoError(t, lenient.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	res, err := lenient.MetaGet("foo", MetaFlags{ReturnValue: true, ReturnFlags: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), res.Value)
+	// connections stay in sync and are reused
+	assert.Len(t, lenient.freeconn[addr], 1)
+}
+
+func TestUnknownCommand(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if f := strings.Fields(line); f[0] == "set" {
+			io.ReadFull(rw, make([]byte, 5))
+		}
+		fmt.Fprintf(rw, "ERROR\r\n")
+	})
+	c := New(addr)
+	ops := map[string]func() error{
+		"gets":   func() error { _, err := c.Get("foo"); return err },
+		"set":    func() error { return c.Set(&Item{Key: "foo", Value: []byte("bar")}) },
+		"delete": func() error { return c.Delete("foo") },
+		"touch":  func() error { return c.Touch("foo", 1) },
+		"incr":   func() error { _, err := c.Increment("foo", 1); return err },
+		"mg":     func() error { _, err := c.MetaGet("foo", MetaFlags{}); return err },
+	}
+	for name, op := range ops {
+		err := op()
+		assert.True(t, errors.Is(err, ErrUnknownCommand), name)
+		var pe *ProtocolError
+		if assert.True(t, errors.As(err, &pe), name) {
+			assert.Equal(t, name, pe.Verb)
+		}
+		assert.Empty(t, c.freeconn[addr], name)
+	}
+}
+
+func benchmarkBinaryGetMulti(b *testing.B, readBufferSize int) {
+	items := make(map[string]string)
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		items[keys[i]] = strings.Repeat("v", 100)
+	}
+	c := New(binaryServer(b, items))
+	c.Binary = true
+	c.Timeout = time.Second
+	c.ReadBufferSize = readBufferSize
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.GetMulti(keys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBinaryGetMulti(b *testing.B) {
+	b.Run("DefaultBuffer", func(b *testing.B) { benchmarkBinaryGetMulti(b, 0) })
+	b.Run("64KBuffer", func(b *testing.B) { benchmarkBinaryGetMulti(b, 64<<10) })
+}
+
+// readCounter counts the reads made on a connection
+type readCounter struct {
+	net.Conn
+	reads int
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	rc.reads++
+	return rc.Conn.Read(p)
+}
+
+// BenchmarkGetMultiReads reports the reads, i.e. syscalls, made per
+// 500-key text multi-get of small values for several read buffer sizes.
+func BenchmarkGetMultiReads(b *testing.B) {
+	for _, size := range []int{0, 16 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("ReadBufferSize=%d", size), func(b *testing.B) {
+			addr, _ := memoryServer(b, -1)
+			c := New(addr)
+			c.Timeout = time.Second
+			c.ReadBufferSize = size
+			keys := make([]string, 500)
+			items := make([]*Item, len(keys))
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key%d", i)
+				items[i] = &Item{Key: keys[i], Value: []byte(strings.Repeat("v", 20))}
+			}
+			if err := c.SetMulti(items); err != nil {
+				b.Fatal(err)
+			}
+			// count the reads of the pooled connection
+			cn := c.freeconn[addr][0]
+			rc := &readCounter{Conn: cn.nc}
+			cn.nc = rc
+			cn.rw = bufio.NewReadWriter(bufio.NewReaderSize(rc, c.readBufferSize()), bufio.NewWriter(rc))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.GetMulti(keys); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(rc.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func BenchmarkBinaryGet(b *testing.B) {
+	items := map[string]string{"key": strings.Repeat("v", 100)}
+	c := New(binaryServer(b, items))
+	c.Binary = true
+	c.Timeout = time.Second
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Get("key"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkValidateIdleAfter measures the cost of the ping made when a
+// pooled connection is validated on every checkout.
+func BenchmarkValidateIdleAfter(b *testing.B) {
+	for _, validate := range []time.Duration{0, time.Nanosecond} {
+		b.Run(fmt.Sprintf("ValidateIdleAfter=%v", validate), func(b *testing.B) {
+			addr := fakeServer(b, func(line string, rw *bufio.ReadWriter) {
+				if line == "version" {
+					fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+					return
+				}
+				fmt.Fprintf(rw, "VALUE key 0 3 1\r\nbar\r\nEND\r\n")
+			})
+			c := New(addr)
+			c.Timeout = time.Second
+			c.ValidateIdleAfter = validate
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Get("key"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
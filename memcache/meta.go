@@ -0,0 +1,466 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The meta protocol is only available as text, and requires memcached 1.6
+// or later. See https://github.com/memcached/memcached/wiki/MetaCommands
+
+var (
+	metaValue    = []byte("VA ")
+	metaHit      = []byte("HD")
+	metaMiss     = []byte("EN")
+	metaNotFound = []byte("NF")
+	metaNotStore = []byte("NS")
+	metaExists   = []byte("EX")
+)
+
+// Meta command modes, for MetaFlags.Mode
+const (
+	// MetaModeIncr and MetaModeDecr are the modes of the "ma" command.
+	MetaModeIncr = 'I'
+	MetaModeDecr = 'D'
+
+	// MetaModeAdd, MetaModeAppend, MetaModePrepend, MetaModeReplace and
+	// MetaModeSet are the modes of the "ms" command.
+	MetaModeAdd     = 'E'
+	MetaModeAppend  = 'A'
+	MetaModePrepend = 'P'
+	MetaModeReplace = 'R'
+	MetaModeSet     = 'S'
+)
+
+// MetaFlags are the flags sent with a meta protocol command. Set flags
+// are sent as is, so only set those that apply to the command issued.
+type MetaFlags struct {
+	// ReturnValue asks for the item's value (v).
+	ReturnValue bool
+	// ReturnKey asks for the item's key (k).
+	ReturnKey bool
+	// ReturnCAS asks for the item's compare and swap ID (c).
+	ReturnCAS bool
+	// ReturnFlags asks for the item's client flags (f).
+	ReturnFlags bool
+	// ReturnTTL asks for the item's remaining time to live (t).
+	ReturnTTL bool
+	// ReturnSize asks for the size of the item's value (s).
+	ReturnSize bool
+
+	// Base64Key sends the key base64 encoded (b), so that it may contain
+	// any bytes, including those the text protocol doesn't allow. The
+	// key is encoded and a returned key decoded by the client; the
+	// encoded key, as sent, must still be at most 250 bytes long. The
+	// server is picked for the key itself, so it is the same one that
+	// commands without Base64Key use.
+	Base64Key bool
+
+	// Mode is the mode switch of the command (M), such as MetaModeIncr.
+	// Zero leaves the command's default mode.
+	Mode byte
+	// Delta is the amount to increment or decrement by (D). Zero leaves
+	// the default of 1.
+	Delta uint64
+	// Initial is the value of an item created by Vivify (J).
+	Initial uint64
+	// Vivify creates the item if it is missing, with VivifyTTL as its
+	// time to live (N).
+	Vivify    bool
+	VivifyTTL int32
+}
+
+// tokens returns the flags formatted as command tokens
+func (f MetaFlags) tokens() []string {
+	var t []string
+	if f.ReturnValue {
+		t = append(t, "v")
+	}
+	if f.ReturnKey {
+		t = append(t, "k")
+	}
+	if f.ReturnCAS {
+		t = append(t, "c")
+	}
+	if f.ReturnFlags {
+		t = append(t, "f")
+	}
+	if f.ReturnTTL {
+		t = append(t, "t")
+	}
+	if f.ReturnSize {
+		t = append(t, "s")
+	}
+	if f.Base64Key {
+		t = append(t, "b")
+	}
+	if f.Mode != 0 {
+		t = append(t, "M"+string(f.Mode))
+	}
+	if f.Delta != 0 {
+		t = append(t, "D"+strconv.FormatUint(f.Delta, 10))
+	}
+	if f.Initial != 0 {
+		t = append(t, "J"+strconv.FormatUint(f.Initial, 10))
+	}
+	if f.Vivify {
+		t = append(t, "N"+strconv.FormatInt(int64(f.VivifyTTL), 10))
+	}
+	return t
+}
+
+// wireKey returns key as sent to the server
+func (f MetaFlags) wireKey(key string) string {
+	if f.Base64Key {
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return key
+}
+
+// withMetaKeyAddr is like withKeyAddr for a meta command with flags,
+// passing fn the key as sent. It is the key as sent that is validated,
+// since that is what the text protocol's limits apply to, but the server
+// is picked for key, so that it doesn't depend on the encoding.
+func (c *Client) withMetaKeyAddr(key string, flags MetaFlags, fn func(addr net.Addr, wire string) error) error {
+	wire := flags.wireKey(key)
+	if err := c.ValidateKey(wire); err != nil {
+		return err
+	}
+	addr, err := c.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+	if c.binaryFor(addr) {
+		return ErrUnsupported
+	}
+	return fn(addr, wire)
+}
+
+func (c *Client) withMetaKeyRw(key string, flags MetaFlags, fn func(rw *bufio.ReadWriter, wire string) error) error {
+	return c.withMetaKeyAddr(key, flags, func(addr net.Addr, wire string) error {
+		return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+			return fn(rw, wire)
+		})
+	})
+}
+
+// MetaResult is the result of a meta protocol command. Fields are only
+// populated if the matching return flag was requested.
+type MetaResult struct {
+	// Key is the item's key.
+	Key string
+
+	// Value is the item's value.
+	Value []byte
+
+	// Flags are the item's client flags.
+	Flags uint32
+
+	// CasID is the item's compare and swap ID.
+	CasID uint64
+
+	// TTL is the item's remaining time to live in seconds, or -1 if
+	// the item has no expiration time.
+	TTL int64
+
+	// Size is the size of the item's value in bytes.
+	Size int
+
+	// Number is the value of a counter after an arithmetic command.
+	Number uint64
+}
+
+// MetaGet gets the item for the given key using the meta protocol "mg"
+// command, returning the metadata requested by flags. ErrCacheMiss is
+// returned for a memcache cache miss. Compressed values are only
+// recognized, and decompressed, if flags.ReturnFlags is set.
+func (c *Client) MetaGet(key string, flags MetaFlags) (res *MetaResult, err error) {
+	c.accessKey("mg", key)
+	err = c.withMetaKeyRw(key, flags, func(rw *bufio.ReadWriter, wire string) error {
+		res, err = c.metaCmd(rw, "mg", wire, flags.tokens(), nil)
+		if err != nil {
+			return err
+		}
+		if err = res.decodeKey(flags); err != nil {
+			return err
+		}
+		if flags.ReturnFlags && res.Value != nil {
+			res.Value, res.Flags, err = c.decompressValue(key, res.Value, res.Flags)
+		}
+		return err
+	})
+	return res, err
+}
+
+// SizeOf returns the size in bytes of the value stored for key, as
+// compressed if it was, without transferring the value, using the meta
+// protocol "mg" command. ErrCacheMiss is returned for a memcache cache
+// miss.
+func (c *Client) SizeOf(key string) (int, error) {
+	res, err := c.MetaGet(key, MetaFlags{ReturnSize: true})
+	if err != nil {
+		return 0, err
+	}
+	return res.Size, nil
+}
+
+// MetaArithmetic increments or decrements the counter at key using the
+// meta protocol "ma" command, returning its new value in Number along
+// with the metadata requested by flags. The direction is set by
+// flags.Mode, and a missing counter is created with flags.Initial if
+// flags.Vivify is set; otherwise ErrCacheMiss is returned for a missing
+// counter.
+func (c *Client) MetaArithmetic(key string, flags MetaFlags) (res *MetaResult, err error) {
+	c.accessKey("ma", key)
+	flags.ReturnValue = true
+	err = c.withMetaKeyRw(key, flags, func(rw *bufio.ReadWriter, wire string) error {
+		res, err = c.metaCmd(rw, "ma", wire, flags.tokens(), nil)
+		if err != nil {
+			return err
+		}
+		if err = res.decodeKey(flags); err != nil {
+			return err
+		}
+		res.Number, err = strconv.ParseUint(string(res.Value), 10, 64)
+		return err
+	})
+	return res, err
+}
+
+// SetMeta stores the given item using the meta protocol "ms" command in
+// the mode set by flags.Mode, for example MetaModeAdd to only store it if
+// it doesn't exist yet. stored reports whether the server stored the
+// item; a false stored with a nil error means the mode's condition
+// wasn't met, such as the key already existing for MetaModeAdd. If
+// flags.ReturnCAS is set, the item's CasID is updated from the response.
+func (c *Client) SetMeta(item *Item, flags MetaFlags) (stored bool, err error) {
+	c.accessKey("ms", item.Key)
+	if err := c.validateItem(item); err != nil {
+		return false, err
+	}
+	err = c.withMetaKeyAddr(item.Key, flags, func(addr net.Addr, key string) error {
+		if flags.Mode != MetaModeAppend && flags.Mode != MetaModePrepend {
+			if err := c.checkItemSize(addr, item); err != nil {
+				return err
+			}
+		}
+		return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+			value, itemFlags := item.Value, item.Flags
+			if flags.Mode != MetaModeAppend && flags.Mode != MetaModePrepend {
+				var err error
+				if value, itemFlags, err = c.compressValue(item); err != nil {
+					return err
+				}
+			}
+			tokens := append([]string{strconv.Itoa(len(value))}, flags.tokens()...)
+			if itemFlags != 0 {
+				tokens = append(tokens, "F"+strconv.FormatUint(uint64(itemFlags), 10))
+			}
+			if item.Expiration != 0 {
+				tokens = append(tokens, "T"+strconv.FormatInt(int64(item.Expiration), 10))
+			}
+			if value == nil {
+				value = []byte{}
+			}
+			res, err := c.metaCmd(rw, "ms", key, tokens, value)
+			if err == ErrNotStored {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			stored = true
+			c.forgetMiss(item.Key)
+			if flags.ReturnCAS {
+				item.CasID = res.CasID
+			}
+			return nil
+		})
+	})
+	return stored, err
+}
+
+// TouchFlags sets both the expiration time and the client flags of the
+// item at key, leaving its value as is, which suits flags that track
+// state changing over an item's life. The meta protocol can't change
+// flags without a value, so the stored value is fetched with "mg" and
+// stored back unchanged with "ms", guarded by its CAS ID: the value is
+// never replaced by a stale one, and ErrCASConflict is returned if the
+// item was modified in between. The reserved bits of the client's
+// FlagLayout are kept from the stored item, as they describe how its
+// value is encoded. ErrCacheMiss is returned if the item doesn't exist.
+func (c *Client) TouchFlags(key string, seconds int32, flags uint32) error {
+	c.accessKey("touch", key)
+	if err := c.checkExpiration(seconds); err != nil {
+		return err
+	}
+	return c.withKeyRw(key, func(rw *bufio.ReadWriter) error {
+		res, err := c.metaCmd(rw, "mg", key, []string{"v", "c", "f"}, nil)
+		if err != nil {
+			return err
+		}
+		reserved := c.flagLayout().ReservedFlags()
+		flags = res.Flags&reserved | flags&^reserved
+		tokens := []string{
+			strconv.Itoa(len(res.Value)),
+			"C" + strconv.FormatUint(res.CasID, 10),
+			"F" + strconv.FormatUint(uint64(flags), 10),
+			"T" + strconv.FormatInt(int64(seconds), 10),
+		}
+		_, err = c.metaCmd(rw, "ms", key, tokens, res.Value)
+		return err
+	})
+}
+
+// AppendCAS appends the given item's value to the stored value, but only
+// if the stored item's CAS ID still matches that of item, as returned by
+// Get. ErrCASConflict is returned if the item was modified in between,
+// ErrNotStored if it doesn't exist, and ErrNoCasID if item's CasID is
+// zero. The item's Flags and Expiration are ignored.
+func (c *Client) AppendCAS(item *Item) error {
+	c.accessKey("ms", item.Key)
+	return c.metaAppend(item, "MA")
+}
+
+// PrependCAS is like AppendCAS, but prepends the given item's value to
+// the stored value.
+func (c *Client) PrependCAS(item *Item) error {
+	c.accessKey("ms", item.Key)
+	return c.metaAppend(item, "MP")
+}
+
+func (c *Client) metaAppend(item *Item, mode string) error {
+	if item.CasID == 0 {
+		return ErrNoCasID
+	}
+	return c.withKeyRw(item.Key, func(rw *bufio.ReadWriter) error {
+		tokens := []string{strconv.Itoa(len(item.Value)), mode, "C" + strconv.FormatUint(item.CasID, 10)}
+		_, err := c.metaCmd(rw, "ms", item.Key, tokens, item.Value)
+		return err
+	})
+}
+
+// metaCmd writes a meta command, followed by value if it is non-nil, and
+// parses the response.
+func (c *Client) metaCmd(rw *bufio.ReadWriter, verb, key string, tokens []string, value []byte) (*MetaResult, error) {
+	if len(tokens) > 0 {
+		_, err := fmt.Fprintf(rw, "%s %s %s\r\n", verb, key, strings.Join(tokens, " "))
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := fmt.Fprintf(rw, "%s %s\r\n", verb, key); err != nil {
+		return nil, err
+	}
+	if value != nil {
+		if _, err := rw.Write(value); err != nil {
+			return nil, err
+		}
+		if _, err := rw.Write(crlf); err != nil {
+			return nil, err
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+	return c.parseMetaResponse(rw.Reader, verb)
+}
+
+// parseMetaResponse reads a single meta command response from r
+func (c *Client) parseMetaResponse(r *bufio.Reader, verb string) (*MetaResult, error) {
+	line, err := c.readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, crlf) {
+		return nil, fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
+	}
+	res := new(MetaResult)
+	switch {
+	case bytes.HasPrefix(line, metaValue):
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("memcache: unexpected response line from %q: %q", verb, string(line))
+		}
+		if res.Value, err = c.readValue(r, size); err != nil {
+			return nil, err
+		}
+		fields = fields[2:]
+	case bytes.HasPrefix(line, metaHit):
+		fields = fields[1:]
+	case bytes.HasPrefix(line, metaMiss), bytes.HasPrefix(line, metaNotFound):
+		return nil, ErrCacheMiss
+	case bytes.HasPrefix(line, metaNotStore):
+		return nil, ErrNotStored
+	case bytes.HasPrefix(line, metaExists):
+		return nil, ErrCASConflict
+	default:
+		return nil, unexpectedResponse(verb, line)
+	}
+	for _, f := range fields {
+		if err := res.parseToken(f); err != nil {
+			return nil, fmt.Errorf("memcache: unexpected flag %q in %q response", f, verb)
+		}
+	}
+	return res, nil
+}
+
+// decodeKey decodes a returned key that was sent base64 encoded
+func (res *MetaResult) decodeKey(flags MetaFlags) error {
+	if !flags.Base64Key || res.Key == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(res.Key)
+	if err != nil {
+		return fmt.Errorf("memcache: malformed base64 key %q in response", res.Key)
+	}
+	res.Key = string(key)
+	return nil
+}
+
+// parseToken populates the field of res matching the returned flag
+func (res *MetaResult) parseToken(f string) (err error) {
+	val := f[1:]
+	switch f[0] {
+	case 'k':
+		res.Key = val
+	case 'c':
+		res.CasID, err = strconv.ParseUint(val, 10, 64)
+	case 'f':
+		var flags uint64
+		flags, err = strconv.ParseUint(val, 10, 32)
+		res.Flags = uint32(flags)
+	case 't':
+		res.TTL, err = strconv.ParseInt(val, 10, 64)
+	case 's':
+		res.Size, err = strconv.Atoi(val)
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetaResponse(t *testing.T) {
+	testCases := []struct {
+		resp string
+		want *MetaResult
+		err  error
+	}{
+		{"VA 3 t-1 f5 c42 kfoo\r\nbar\r\n", &MetaResult{Key: "foo", Value: []byte("bar"), Flags: 5, CasID: 42, TTL: -1}, nil},
+		{"VA 0\r\n\r\n", &MetaResult{Value: []byte{}}, nil},
+		{"HD t30 s7\r\n", &MetaResult{TTL: 30, Size: 7}, nil},
+		{"EN\r\n", nil, ErrCacheMiss},
+		{"NF\r\n", nil, ErrCacheMiss},
+		{"NS\r\n", nil, ErrNotStored},
+		{"EX\r\n", nil, ErrCASConflict},
+	}
+	for _, tc := range testCases {
+		res, err := new(Client).parseMetaResponse(bufio.NewReader(strings.NewReader(tc.resp)), "mg")
+		assert.Equal(t, tc.err, err, tc.resp)
+		assert.Equal(t, tc.want, res, tc.resp)
+	}
+
+	_, err := new(Client).parseMetaResponse(bufio.NewReader(strings.NewReader("VA 5\r\nbar\r\n")), "mg")
+	assert.Error(t, err)
+	_, err = new(Client).parseMetaResponse(bufio.NewReader(strings.NewReader("SERVER_ERROR out of memory\r\n")), "mg")
+	assert.Error(t, err)
+}
+
+func TestAppendCAS(t *testing.T) {
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		f := strings.Fields(line)
+		var n int
+		fmt.Sscanf(f[2], "%d", &n)
+		io.ReadFull(rw, make([]byte, n+2))
+		if f[4] == "C5" {
+			fmt.Fprintf(rw, "HD\r\n")
+		} else {
+			fmt.Fprintf(rw, "EX\r\n")
+		}
+	})
+	c := New(addr)
+	assert.NoError(t, c.AppendCAS(&Item{Key: "foo", Value: []byte("bar"), CasID: 5}))
+	assert.Equal(t, ErrCASConflict, c.PrependCAS(&Item{Key: "foo", Value: []byte("bar"), CasID: 4}))
+	assert.Equal(t, ErrNoCasID, c.AppendCAS(&Item{Key: "foo", Value: []byte("bar")}))
+	assert.Equal(t, ErrNoCasID, c.PrependCAS(&Item{Key: "foo", Value: []byte("bar")}))
+	assert.Equal(t, []string{"ms foo 3 MA C5", "ms foo 3 MP C4"}, lines)
+}
+
+func TestSetMeta(t *testing.T) {
+	var lines []string
+	exists := map[string]bool{}
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		f := strings.Fields(line)
+		var n int
+		fmt.Sscanf(f[2], "%d", &n)
+		io.ReadFull(rw, make([]byte, n+2))
+		if exists[f[1]] {
+			fmt.Fprintf(rw, "NS\r\n")
+			return
+		}
+		exists[f[1]] = true
+		fmt.Fprintf(rw, "HD c9\r\n")
+	})
+	c := New(addr)
+	item := &Item{Key: "lock", Value: []byte("me"), Flags: 3, Expiration: 10}
+	stored, err := c.SetMeta(item, MetaFlags{Mode: MetaModeAdd, ReturnCAS: true})
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	assert.Equal(t, uint64(9), item.CasID)
+
+	stored, err = c.SetMeta(&Item{Key: "lock"}, MetaFlags{Mode: MetaModeAdd})
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	assert.Equal(t, []string{"ms lock 2 c ME F3 T10", "ms lock 0 ME"}, lines)
+}
+
+func TestMetaBase64Key(t *testing.T) {
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		f := strings.Fields(line)
+		if f[0] == "ms" {
+			io.ReadFull(rw, make([]byte, 5))
+			fmt.Fprintf(rw, "HD b\r\n")
+			return
+		}
+		fmt.Fprintf(rw, "VA 3 b k%s\r\nbar\r\n", f[1])
+	})
+	c := New(addr)
+	key := "bin\x00 key\n"
+	stored, err := c.SetMeta(&Item{Key: key, Value: []byte("bar")}, MetaFlags{Base64Key: true})
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	res, err := c.MetaGet(key, MetaFlags{ReturnValue: true, ReturnKey: true, Base64Key: true})
+	assert.NoError(t, err)
+	assert.Equal(t, key, res.Key)
+	assert.Equal(t, []byte("bar"), res.Value)
+	assert.Equal(t, []string{"ms YmluACBrZXkK 3 b", "mg YmluACBrZXkK v k b"}, lines)
+
+	_, err = c.MetaGet(key, MetaFlags{})
+	assert.ErrorIs(t, err, ErrMalformedKey)
+}
+
+func TestMetaBase64KeyServer(t *testing.T) {
+	var lines [2][]string
+	var addrs [2]string
+	for i := range addrs {
+		i := i
+		addrs[i] = fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+			lines[i] = append(lines[i], line)
+			if strings.HasPrefix(line, "ms ") {
+				io.ReadFull(rw, make([]byte, 5))
+				fmt.Fprintf(rw, "HD\r\n")
+				return
+			}
+			fmt.Fprintf(rw, "EN\r\n")
+		})
+	}
+	c := New(addrs[0], addrs[1])
+	var key string
+	for i := 0; i < 1000 && key == ""; i++ {
+		k := fmt.Sprintf("key%d", i)
+		a, err := c.selector.PickServer(k)
+		assert.NoError(t, err)
+		b, err := c.selector.PickServer(base64.StdEncoding.EncodeToString([]byte(k)))
+		assert.NoError(t, err)
+		if a.String() != b.String() {
+			key = k
+		}
+	}
+	if key == "" {
+		t.Fatal("no key found whose encoding picks another server")
+	}
+	addr, err := c.selector.PickServer(key)
+	assert.NoError(t, err)
+	i := 0
+	if addr.String() == addrs[1] {
+		i = 1
+	}
+
+	_, err = c.SetMeta(&Item{Key: key, Value: []byte("bar")}, MetaFlags{Base64Key: true})
+	assert.NoError(t, err)
+	_, err = c.MetaGet(key, MetaFlags{Base64Key: true})
+	assert.ErrorIs(t, err, ErrCacheMiss)
+	wire := base64.StdEncoding.EncodeToString([]byte(key))
+	assert.Equal(t, []string{"ms " + wire + " 3 b", "mg " + wire + " b"}, lines[i])
+	assert.Empty(t, lines[1-i])
+}
+
+func TestMetaArithmetic(t *testing.T) {
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		if strings.Contains(line, "N") {
+			fmt.Fprintf(rw, "VA 2 t60 c7\r\n10\r\n")
+		} else {
+			fmt.Fprintf(rw, "NF\r\n")
+		}
+	})
+	c := New(addr)
+	_, err := c.MetaArithmetic("hits", MetaFlags{})
+	assert.Equal(t, ErrCacheMiss, err)
+
+	res, err := c.MetaArithmetic("hits", MetaFlags{
+		ReturnTTL: true,
+		ReturnCAS: true,
+		Mode:      MetaModeDecr,
+		Delta:     5,
+		Initial:   10,
+		Vivify:    true,
+		VivifyTTL: 60,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), res.Number)
+	assert.Equal(t, int64(60), res.TTL)
+	assert.Equal(t, uint64(7), res.CasID)
+	assert.Equal(t, []string{"ma hits v", "ma hits v c t MD D5 J10 N60"}, lines)
+}
+
+func TestTouchFlags(t *testing.T) {
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		f := strings.Fields(line)
+		switch {
+		case f[0] == "mg" && f[1] == "gone":
+			fmt.Fprintf(rw, "EN\r\n")
+		case f[0] == "mg":
+			fmt.Fprintf(rw, "VA 3 c5 f%d\r\nbar\r\n", CompressedFlag|1)
+		default:
+			io.ReadFull(rw, make([]byte, 5))
+			if f[3] == "C5" && f[1] == "foo" {
+				fmt.Fprintf(rw, "HD\r\n")
+			} else {
+				fmt.Fprintf(rw, "EX\r\n")
+			}
+		}
+	})
+	c := New(addr)
+	assert.NoError(t, c.TouchFlags("foo", 60, 2))
+	assert.Equal(t, ErrCASConflict, c.TouchFlags("raced", 60, 2))
+	assert.Equal(t, ErrCacheMiss, c.TouchFlags("gone", 60, 2))
+	assert.Equal(t, []string{
+		"mg foo v c f",
+		fmt.Sprintf("ms foo 3 C5 F%d T60", CompressedFlag|2),
+		"mg raced v c f",
+		fmt.Sprintf("ms raced 3 C5 F%d T60", CompressedFlag|2),
+		"mg gone v c f",
+	}, lines)
+}
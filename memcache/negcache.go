@@ -0,0 +1,114 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultNegativeCacheSize is the default number of missed keys
+// remembered when NegativeCacheTTL is set.
+const DefaultNegativeCacheSize = 1024
+
+// negativeCache is a bounded LRU of recently missed keys, each remembered
+// until it expires. Its zero value is usable.
+type negativeCache struct {
+	mu    sync.Mutex
+	ll    *list.List // of *negativeEntry, most recently missed first
+	byKey map[string]*list.Element
+}
+
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+// has reports whether key missed before now and hasn't expired yet
+func (nc *negativeCache) has(key string, now time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	e, ok := nc.byKey[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(e.Value.(*negativeEntry).expires) {
+		nc.ll.Remove(e)
+		delete(nc.byKey, key)
+		return false
+	}
+	return true
+}
+
+// add remembers that key missed until expires, evicting the least
+// recently missed keys beyond size.
+func (nc *negativeCache) add(key string, expires time.Time, size int) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.byKey == nil {
+		nc.ll = list.New()
+		nc.byKey = make(map[string]*list.Element)
+	}
+	if e, ok := nc.byKey[key]; ok {
+		e.Value.(*negativeEntry).expires = expires
+		nc.ll.MoveToFront(e)
+		return
+	}
+	nc.byKey[key] = nc.ll.PushFront(&negativeEntry{key: key, expires: expires})
+	for nc.ll.Len() > size {
+		e := nc.ll.Back()
+		nc.ll.Remove(e)
+		delete(nc.byKey, e.Value.(*negativeEntry).key)
+	}
+}
+
+// remove forgets key
+func (nc *negativeCache) remove(key string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if e, ok := nc.byKey[key]; ok {
+		nc.ll.Remove(e)
+		delete(nc.byKey, key)
+	}
+}
+
+func (c *Client) negativeCacheSize() int {
+	if c.NegativeCacheSize > 0 {
+		return c.NegativeCacheSize
+	}
+	return DefaultNegativeCacheSize
+}
+
+// knownMiss reports whether key recently missed, per NegativeCacheTTL
+func (c *Client) knownMiss(key string) bool {
+	return c.NegativeCacheTTL > 0 && c.misses.has(key, c.timeNow())
+}
+
+// rememberMiss records that key missed, if NegativeCacheTTL is set
+func (c *Client) rememberMiss(key string) {
+	if c.NegativeCacheTTL > 0 {
+		c.misses.add(key, c.timeNow().Add(c.NegativeCacheTTL), c.negativeCacheSize())
+	}
+}
+
+// forgetMiss is called once key is stored, so that Get reads it again
+func (c *Client) forgetMiss(key string) {
+	if c.NegativeCacheTTL > 0 {
+		c.misses.remove(key)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegativeCache(t *testing.T) {
+	var gets int32
+	c := New(fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		f := strings.Fields(line)
+		switch f[0] {
+		case "gets":
+			atomic.AddInt32(&gets, 1)
+			fmt.Fprintf(rw, "END\r\n")
+		case "set":
+			var n int
+			fmt.Sscanf(f[4], "%d", &n)
+			io.ReadFull(rw, make([]byte, n+2))
+			fmt.Fprintf(rw, "STORED\r\n")
+		}
+	}))
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.NegativeCacheTTL = time.Minute
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Get("foo")
+		assert.Equal(t, ErrCacheMiss, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+
+	now = now.Add(time.Minute)
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	// storing the key forgets its miss
+	assert.NoError(t, c.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&gets))
+}
+
+func TestNegativeCacheBounded(t *testing.T) {
+	var nc negativeCache
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	nc.add("a", expires, 2)
+	nc.add("b", expires, 2)
+	nc.add("a", expires, 2) // a is now the most recent
+	nc.add("c", expires, 2)
+	assert.True(t, nc.has("a", now))
+	assert.False(t, nc.has("b", now))
+	assert.True(t, nc.has("c", now))
+	assert.False(t, nc.has("c", expires))
+
+	nc.remove("a")
+	assert.False(t, nc.has("a", now))
+	assert.Equal(t, 0, nc.ll.Len())
+}
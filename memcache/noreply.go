@@ -0,0 +1,209 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+)
+
+// DefaultNoReplySyncInterval is the default number of noreply commands
+// sent on a connection between syncs.
+const DefaultNoReplySyncInterval = 100
+
+func (c *Client) noReplySyncInterval() int {
+	if c.NoReplySyncInterval > 0 {
+		return c.NoReplySyncInterval
+	}
+	return DefaultNoReplySyncInterval
+}
+
+// DeleteNoReply deletes the item with the provided key without waiting
+// for the server's reply, for high-volume invalidation. This gives
+// weaker guarantees than Delete: a nil error only means that the command
+// was sent, not that the item existed or was deleted. Every
+// NoReplySyncInterval noreply commands on a connection, the server is
+// synced with, and an error from any of them is returned then, by
+// whichever call syncs, without telling which command failed. An error
+// that occurs between syncs is dropped along with its connection if
+// another operation takes the connection, as it is synced with first.
+// Sync forces a sync.
+func (c *Client) DeleteNoReply(key string) error {
+	c.accessKey("delete", key)
+	return c.withKeyAddr(key, func(addr net.Addr) error {
+		return c.withNoReplyConn(addr, func(cn *conn) error {
+			return cn.deleteNoReply(key)
+		})
+	})
+}
+
+// DeleteMultiNoReply is like DeleteNoReply for many keys. The deletes of
+// each server are pipelined on a single connection, and the server is
+// synced with after the last one, so that an error is returned if any
+// of them fails. If some servers fail, the returned error is a
+// ServerErrors.
+func (c *Client) DeleteMultiNoReply(keys []string) error {
+	c.accessKeys("delete", keys)
+	keyMap, err := c.keysByAddr(keys)
+	if err != nil {
+		return err
+	}
+	addrs := make([]net.Addr, 0, len(keyMap))
+	for addr := range keyMap {
+		addrs = append(addrs, addr)
+	}
+	return parallel(addrs, func(addr net.Addr) error {
+		return c.withNoReplyConn(addr, func(cn *conn) error {
+			for _, key := range keyMap[addr] {
+				if err := cn.deleteNoReply(key); err != nil {
+					return err
+				}
+			}
+			if cn.noreplies == 0 {
+				return nil
+			}
+			return cn.syncNoReply()
+		})
+	})
+}
+
+// Sync waits for server to have processed the noreply commands sent on
+// the client's idle connections to it, such as those of DeleteNoReply,
+// as a checkpoint for fire-and-forget workloads. Each such connection is
+// synced with as its NoReplySyncInterval would, and the first error found
+// is returned, without telling which command failed; connections in use
+// by other operations at the time aren't synced with.
+func (c *Client) Sync(server net.Addr) error {
+	c.lk.Lock()
+	var pending []*conn
+	if freelist, ok := c.freeconn[server.String()]; ok {
+		kept := freelist[:0]
+		for _, cn := range freelist {
+			if cn.noreplies > 0 {
+				pending = append(pending, cn)
+			} else {
+				kept = append(kept, cn)
+			}
+		}
+		c.freeconn[server.String()] = kept
+	}
+	c.lk.Unlock()
+
+	var firstErr error
+	for _, cn := range pending {
+		if err := c.syncIdle(cn); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// syncIdle syncs with cn, taken from the pool, before returning it
+func (c *Client) syncIdle(cn *conn) (err error) {
+	if err = c.takeIdle(cn); err != nil {
+		return err
+	}
+	defer cn.condRelease(&err)
+	return cn.syncNoReply()
+}
+
+// takeIdle readies cn, taken from the pool, for use as getConn does
+func (c *Client) takeIdle(cn *conn) (err error) {
+	cn.c = c
+	if cn.slot, err = c.acquireSlot(context.Background(), cn.addr); err != nil {
+		_ = cn.nc.Close()
+		return err
+	}
+	if err = c.trackInUse(cn); err != nil {
+		cn.close()
+		return err
+	}
+	if err = cn.extendDeadline(); err != nil {
+		cn.close()
+		return err
+	}
+	return nil
+}
+
+// withNoReplyConn calls fn with a text protocol connection to addr,
+// preferring an idle one that noreply commands are pending on, which
+// getConn would sync with first
+func (c *Client) withNoReplyConn(addr net.Addr, fn func(*conn) error) (err error) {
+	if c.binaryFor(addr) {
+		return ErrUnsupported
+	}
+	cn, err := c.getPendingConn(addr)
+	if err != nil {
+		return err
+	}
+	defer cn.condRelease(&err)
+	return fn(cn)
+}
+
+// getPendingConn is like getConn, but takes an idle connection to addr
+// with pending noreply commands if there is one.
+func (c *Client) getPendingConn(addr net.Addr) (*conn, error) {
+	var cn *conn
+	c.lk.Lock()
+	freelist := c.freeconn[addr.String()]
+	for i := len(freelist) - 1; i >= 0; i-- {
+		if freelist[i].noreplies > 0 {
+			cn = freelist[i]
+			c.freeconn[addr.String()] = append(freelist[:i:i], freelist[i+1:]...)
+			break
+		}
+	}
+	c.lk.Unlock()
+	if cn == nil {
+		return c.getConn(addr)
+	}
+	if err := c.takeIdle(cn); err != nil {
+		return nil, err
+	}
+	return cn, nil
+}
+
+// deleteNoReply sends a noreply delete of key on cn, syncing if it is
+// due
+func (cn *conn) deleteNoReply(key string) error {
+	if _, err := fmt.Fprintf(cn.rw, "delete %s noreply\r\n", key); err != nil {
+		return err
+	}
+	cn.noreplies++
+	if cn.noreplies >= cn.c.noReplySyncInterval() {
+		return cn.syncNoReply()
+	}
+	return cn.rw.Flush()
+}
+
+// syncNoReply waits for the server to have processed the noreply
+// commands sent on cn, by sending a version command after them. Since
+// successful noreply commands send nothing, any reply before VERSION is
+// the error of one of them.
+func (cn *conn) syncNoReply() error {
+	cn.noreplies = 0
+	line, err := cn.c.writeReadLine(cn.rw, "version\r\n")
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(line, resultVersionPrefix) {
+		return unexpectedResponse("delete", line)
+	}
+	return nil
+}
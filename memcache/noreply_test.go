@@ -0,0 +1,132 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteNoReply(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	syncs := 0
+	c := New(fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		mu.Lock()
+		defer mu.Unlock()
+		f := strings.Fields(line)
+		switch {
+		case f[0] == "delete" && len(f) == 3 && f[2] == "noreply":
+			deleted = append(deleted, f[1])
+			if f[1] == "bad" {
+				fmt.Fprintf(rw, "SERVER_ERROR out of memory\r\n")
+			}
+		case f[0] == "version":
+			syncs++
+			fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+		}
+	}))
+	c.NoReplySyncInterval = 3
+
+	assert.NoError(t, c.DeleteNoReply("a"))
+	assert.NoError(t, c.DeleteNoReply("b"))
+	assert.NoError(t, c.DeleteNoReply("c")) // syncs
+	assert.NoError(t, c.DeleteMultiNoReply([]string{"d", "e", "f", "g"}))
+	mu.Lock()
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g"}, deleted)
+	assert.Equal(t, 3, syncs)
+	mu.Unlock()
+
+	err := c.DeleteMultiNoReply([]string{"h", "bad"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "SERVER_ERROR")
+
+	assert.ErrorIs(t, c.DeleteNoReply("bad key"), ErrMalformedKey)
+}
+
+func TestSync(t *testing.T) {
+	var mu sync.Mutex
+	syncs := 0
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		mu.Lock()
+		defer mu.Unlock()
+		f := strings.Fields(line)
+		switch {
+		case f[0] == "delete" && f[1] == "bad":
+			fmt.Fprintf(rw, "SERVER_ERROR out of memory\r\n")
+		case f[0] == "version":
+			syncs++
+			fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+		}
+	})
+	c := New(addr)
+	server, err := net.ResolveTCPAddr("tcp", addr)
+	assert.NoError(t, err)
+
+	// nothing pending
+	assert.NoError(t, c.Sync(server))
+	assert.NoError(t, c.DeleteNoReply("a"))
+	assert.NoError(t, c.Sync(server))
+	assert.NoError(t, c.Sync(server))
+	mu.Lock()
+	assert.Equal(t, 1, syncs)
+	mu.Unlock()
+	assert.Len(t, c.freeconn[addr], 1)
+
+	assert.NoError(t, c.DeleteNoReply("bad"))
+	err = c.Sync(server)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "SERVER_ERROR")
+	assert.Empty(t, c.freeconn[addr])
+}
+
+func TestNoReplyErrorNotReadByOtherOps(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	c := New(fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, line)
+		f := strings.Fields(line)
+		switch f[0] {
+		case "delete":
+			fmt.Fprintf(rw, "SERVER_ERROR out of memory\r\n")
+		case "version":
+			fmt.Fprintf(rw, "VERSION 1.6.21\r\n")
+		case "gets":
+			fmt.Fprintf(rw, "END\r\n")
+		}
+	}))
+
+	// noreply commands are batched on the pooled connection
+	assert.NoError(t, c.DeleteNoReply("a"))
+	assert.NoError(t, c.DeleteNoReply("b"))
+	// which a Get syncs with before it uses it
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+	mu.Lock()
+	assert.Equal(t, []string{"delete a noreply", "delete b noreply", "version", "gets foo", "gets foo"}, lines)
+	mu.Unlock()
+}
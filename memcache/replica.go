@@ -0,0 +1,172 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"net"
+)
+
+// replicas returns the servers key is replicated to, or nil if it
+// isn't replicated.
+func (c *Client) replicas(key string) ([]net.Addr, error) {
+	rs, ok := c.selector.(ReplicaSelector)
+	if !ok || c.ReplicatedKey == nil || !c.ReplicatedKey(key) {
+		return nil, nil
+	}
+	if err := c.ValidateKey(key); err != nil {
+		return nil, err
+	}
+	addrs, err := rs.PickReplicas(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) < 2 {
+		return nil, nil
+	}
+	return addrs, nil
+}
+
+// getReplicas gets key from addrs, ReplicaReads at a time, and returns
+// the first hit. If there is none, ErrCacheMiss is returned if any
+// replica reported a miss, and otherwise one of the errors.
+func (c *Client) getReplicas(addrs []net.Addr, key string) (*Item, error) {
+	n := c.ReplicaReads
+	if n < 1 || n > len(addrs) {
+		n = len(addrs)
+	}
+	var err error
+	for start := 0; start < len(addrs); start += n {
+		end := start + n
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		it, ge := c.getReplicasAtOnce(addrs[start:end], key)
+		if ge == nil {
+			return it, nil
+		}
+		if err != ErrCacheMiss {
+			err = ge
+		}
+	}
+	return nil, err
+}
+
+// getReplicasAtOnce gets key from all of addrs concurrently, see
+// getReplicas.
+func (c *Client) getReplicasAtOnce(addrs []net.Addr, key string) (*Item, error) {
+	type result struct {
+		it  *Item
+		err error
+	}
+	ch := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr net.Addr) {
+			var it *Item
+			err := c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+				return c.getKeys(rw, c.binaryFor(addr), nil, []string{key}, func(found *Item) error {
+					it = found
+					return nil
+				})
+			})
+			if err == nil && it == nil {
+				err = ErrCacheMiss
+			}
+			ch <- result{it, err}
+		}(addr)
+	}
+	var err error
+	for range addrs {
+		r := <-ch
+		if r.err == nil {
+			return r.it, nil
+		}
+		if err != ErrCacheMiss {
+			err = r.err
+		}
+	}
+	return nil, err
+}
+
+// storeReplicas stores item on all of addrs concurrently with fn. If
+// every replica fails with ErrNotStored, or every one with
+// ErrCASConflict, that error is returned; otherwise, if any replica
+// fails, the returned error is a ServerErrors. The item's CasID is
+// updated from the first replica, if fn does so.
+func (c *Client) storeReplicas(addrs []net.Addr, item *Item, fn doer) error {
+	items := make(map[net.Addr]*Item, len(addrs))
+	for _, addr := range addrs {
+		it := *item
+		items[addr] = &it
+	}
+	err := parallel(addrs, func(addr net.Addr) error {
+		_, err := c.onAddr(addr, items[addr], fn)
+		return err
+	})
+	item.CasID = items[addrs[0]].CasID
+	errs, ok := err.(ServerErrors)
+	if !ok || len(errs) < len(addrs) {
+		return err
+	}
+	for _, sentinel := range []error{ErrNotStored, ErrCASConflict} {
+		same := 0
+		for _, err := range errs {
+			if err == sentinel {
+				same++
+			}
+		}
+		if same == len(addrs) {
+			return sentinel
+		}
+	}
+	return errs
+}
+
+// deleteReplicas deletes key from all of addrs. ErrCacheMiss is only
+// returned if every replica reports a miss; other failures are returned
+// as a ServerErrors.
+func (c *Client) deleteReplicas(addrs []net.Addr, key string) error {
+	if c.Binary {
+		return ErrUnsupported
+	}
+	err := parallel(addrs, func(addr net.Addr) error {
+		if c.binaryFor(addr) {
+			return ErrUnsupported
+		}
+		return c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+			return c.writeExpectf(rw, resultDeleted, "delete %s\r\n", key)
+		})
+	})
+	errs, ok := err.(ServerErrors)
+	if !ok {
+		return err
+	}
+	misses := 0
+	for addr, err := range errs {
+		if err == ErrCacheMiss {
+			misses++
+			delete(errs, addr)
+		}
+	}
+	if misses == len(addrs) {
+		return ErrCacheMiss
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
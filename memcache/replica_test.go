@@ -0,0 +1,129 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaListPickReplicas(t *testing.T) {
+	var rl ReplicaList
+	assert.NoError(t, rl.SetServers("127.0.0.1:1234", "127.0.0.1:1235", "127.0.0.1:1234", "127.0.0.1:1236"))
+	addrs, err := rl.PickReplicas("foo")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 1)
+
+	rl.SetReplicas(3)
+	for _, key := range []string{"foo", "bar", "baz"} {
+		addrs, err := rl.PickReplicas(key)
+		assert.NoError(t, err)
+		assert.Len(t, addrs, 3)
+		first, err := rl.PickServer(key)
+		assert.NoError(t, err)
+		assert.Equal(t, first, addrs[0])
+	}
+
+	rl.SetReplicas(10)
+	addrs, err = rl.PickReplicas("foo")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 3)
+}
+
+func TestReplicatedKeys(t *testing.T) {
+	addr1, stored1 := memoryServer(t, -1)
+	addr2, stored2 := memoryServer(t, -1)
+	var rl ReplicaList
+	assert.NoError(t, rl.SetServers(addr1, addr2))
+	rl.SetReplicas(2)
+	c := NewFromSelector(&rl)
+	c.ReplicatedKey = func(key string) bool { return key != "single" }
+
+	assert.NoError(t, c.Set(&Item{Key: "hot", Value: []byte("v")}))
+	assert.Equal(t, "v", stored1("hot"))
+	assert.Equal(t, "v", stored2("hot"))
+
+	assert.NoError(t, c.Set(&Item{Key: "single", Value: []byte("v")}))
+	assert.Equal(t, 1, len(stored1("single")+stored2("single")))
+
+	// a hit on any replica is returned
+	only2 := New(addr2)
+	assert.NoError(t, only2.Set(&Item{Key: "partial", Value: []byte("p")}))
+	it, err := c.Get("partial")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("p"), it.Value)
+
+	_, err = c.Get("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+
+	// a conditional store that fails on every replica returns the sentinel
+	assert.Equal(t, ErrNotStored, c.Add(&Item{Key: "hot", Value: []byte("w")}))
+	assert.Equal(t, ErrNotStored, c.Rename("partial", "hot"))
+	assert.Equal(t, "v", stored1("hot"))
+}
+
+func TestDeleteReplicas(t *testing.T) {
+	deleted := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "DELETED\r\n")
+	})
+	missing := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "NOT_FOUND\r\n")
+	})
+	c := New()
+	addrs := make([]net.Addr, 2)
+	for i, server := range []string{deleted, missing} {
+		addr, err := resolveAddr(server)
+		assert.NoError(t, err)
+		addrs[i] = addr
+	}
+	assert.NoError(t, c.deleteReplicas(addrs, "foo"))
+	assert.Equal(t, ErrCacheMiss, c.deleteReplicas(addrs[1:], "foo"))
+}
+
+func TestReplicaReads(t *testing.T) {
+	var gets [2]int
+	server := func(i int, hit bool) string {
+		return fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+			gets[i]++
+			if hit {
+				fmt.Fprintf(rw, "VALUE hot 0 1 1\r\nv\r\n")
+			}
+			fmt.Fprintf(rw, "END\r\n")
+		})
+	}
+	addrs := make([]net.Addr, 2)
+	for i, server := range []string{server(0, false), server(1, true)} {
+		addr, err := resolveAddr(server)
+		assert.NoError(t, err)
+		addrs[i] = addr
+	}
+	c := New()
+	c.ReplicaReads = 1
+	it, err := c.getReplicas(addrs, "hot")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), it.Value)
+	assert.Equal(t, [2]int{1, 1}, gets)
+
+	// the second replica isn't read after a hit on the first
+	_, err = c.getReplicas([]net.Addr{addrs[1], addrs[0]}, "hot")
+	assert.NoError(t, err)
+	assert.Equal(t, [2]int{1, 2}, gets)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"net"
+	"sync"
+)
+
+// SelectionCache caches the servers a client's selector picks for a
+// fixed set of keys that is queried repeatedly, saving the PickServer
+// call per key on every query. The cached selection is recomputed when
+// the selector changes, such as by ServerList.SetServers or
+// PrefixSelector.SetPrefix, or, for selectors of other packages, when
+// the client's servers change, as reported by Client.Servers. It is safe
+// for concurrent use by multiple goroutines.
+type SelectionCache struct {
+	c    *Client
+	keys []string
+
+	mu      sync.Mutex
+	version uint64
+	servers []string // for selectors without a version
+	addrs   map[string]net.Addr
+	byAddr  map[net.Addr][]string
+}
+
+// NewSelectionCache returns a SelectionCache for keys, which must not be
+// modified afterwards.
+func (c *Client) NewSelectionCache(keys []string) *SelectionCache {
+	return &SelectionCache{c: c, keys: keys}
+}
+
+// Addrs returns the server of each key. The map is shared by callers
+// until the selection is recomputed, so it must not be modified.
+func (sc *SelectionCache) Addrs() (map[string]net.Addr, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if err := sc.update(); err != nil {
+		return nil, err
+	}
+	return sc.addrs, nil
+}
+
+// GetMulti is like Client.GetMulti for the cached keys, but uses the
+// cached selection.
+func (sc *SelectionCache) GetMulti() (map[string]*Item, error) {
+	sc.c.accessKeys("get", sc.keys)
+	sc.mu.Lock()
+	err := sc.update()
+	byAddr := sc.byAddr
+	sc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return sc.c.getMultiFromAddrs(byAddr, sc.c.GetMultiOnError)
+}
+
+// update recomputes the selection if the selector changed. sc.mu must
+// be held.
+func (sc *SelectionCache) update() error {
+	var version uint64
+	var servers []string
+	versioned := false
+	if vs, ok := sc.c.selector.(versionedSelector); ok {
+		version, versioned = vs.selectionVersion()
+	}
+	if !versioned {
+		servers = sc.c.Servers()
+	}
+	if sc.addrs != nil && version == sc.version && equalStrings(servers, sc.servers) {
+		return nil
+	}
+	byAddr, err := sc.c.keysByAddr(sc.keys)
+	if err != nil {
+		return err
+	}
+	addrs := make(map[string]net.Addr, len(sc.keys))
+	for addr, keys := range byAddr {
+		for _, key := range keys {
+			addrs[key] = addr
+		}
+	}
+	sc.version, sc.servers, sc.addrs, sc.byAddr = version, servers, addrs, byAddr
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
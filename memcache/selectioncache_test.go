@@ -0,0 +1,92 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingSelector counts the calls to PickServer
+type countingSelector struct {
+	ServerList
+	picks int
+}
+
+func (cs *countingSelector) PickServer(key string) (net.Addr, error) {
+	cs.picks++
+	return cs.ServerList.PickServer(key)
+}
+
+func TestSelectionCache(t *testing.T) {
+	addr1, _ := memoryServer(t, -1)
+	addr2, _ := memoryServer(t, -1)
+	var cs countingSelector
+	assert.NoError(t, cs.SetServers(addr1, addr2))
+	c := NewFromSelector(&cs)
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		assert.NoError(t, c.Set(&Item{Key: key, Value: []byte(key)}))
+	}
+
+	sc := c.NewSelectionCache(keys)
+	cs.picks = 0
+	for i := 0; i < 3; i++ {
+		m, err := sc.GetMulti()
+		assert.NoError(t, err)
+		assert.Len(t, m, len(keys))
+	}
+	assert.Equal(t, len(keys), cs.picks)
+
+	addrs, err := sc.Addrs()
+	assert.NoError(t, err)
+	for _, key := range keys {
+		want, err := cs.ServerList.PickServer(key)
+		assert.NoError(t, err)
+		assert.Equal(t, want, addrs[key])
+	}
+
+	// a change of servers invalidates the selection
+	assert.NoError(t, cs.SetServers(addr1))
+	addrs, err = sc.Addrs()
+	assert.NoError(t, err)
+	for _, key := range keys {
+		assert.Equal(t, addr1, addrs[key].String())
+	}
+}
+
+func TestSelectionCachePrefixRemap(t *testing.T) {
+	addr1, _ := memoryServer(t, -1)
+	addr2, _ := memoryServer(t, -1)
+	var ps PrefixSelector
+	assert.NoError(t, ps.SetDefault(addr1, addr2))
+	assert.NoError(t, ps.SetPrefix("t:", addr1))
+	c := NewFromSelector(&ps)
+	sc := c.NewSelectionCache([]string{"t:a"})
+	addrs, err := sc.Addrs()
+	assert.NoError(t, err)
+	assert.Equal(t, addr1, addrs["t:a"].String())
+
+	// remapping the prefix invalidates the selection, though the set of
+	// servers stays the same
+	assert.NoError(t, ps.SetPrefix("t:", addr2))
+	addrs, err = sc.Addrs()
+	assert.NoError(t, err)
+	assert.Equal(t, addr2, addrs["t:a"].String())
+}
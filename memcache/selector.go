@@ -17,8 +17,10 @@ limitations under the License.
 package memcache
 
 import (
+	"fmt"
 	"hash/crc32"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -31,18 +33,64 @@ type ServerSelector interface {
 	// PickServer returns the server address that a given item
 	// should be shared onto.
 	PickServer(key string) (net.Addr, error)
-	Each(func(net.Addr) error) error
+	// Each calls f for each server, stopping at and returning the first
+	// error f returns. The client uses it to fan out to all servers, and
+	// callers may use it to run their own per-server logic over the same
+	// set. It must be safe to call concurrently with PickServer, and f
+	// may call the selector's other methods.
+	Each(f func(net.Addr) error) error
+}
+
+// ProtocolSelector is a ServerSelector for a fleet in which some servers
+// only speak the binary protocol. A Client whose Binary field is false
+// uses the binary protocol for the servers IsBinary reports, and the
+// text protocol for all others.
+type ProtocolSelector interface {
+	ServerSelector
+	// IsBinary reports whether addr, as returned by PickServer, speaks
+	// the binary protocol.
+	IsBinary(addr net.Addr) bool
+}
+
+// versionedSelector is implemented by the selectors of this package so
+// that the servers they pick can be cached, as by SelectionCache. The
+// version changes whenever PickServer may return another server for
+// some key; ok is false if the selector can't tell.
+type versionedSelector interface {
+	selectionVersion() (version uint64, ok bool)
 }
 
 // ServerList is a simple ServerSelector. Its zero value is usable.
 type ServerList struct {
-	mu    sync.RWMutex
-	addrs []net.Addr
+	mu      sync.RWMutex
+	addrs   []net.Addr
+	binary  map[string]bool
+	dups    DuplicatePolicy
+	version uint64 // bumped by SetServers
 }
 
-// staticAddr caches the Network() and String() values from any net.Addr.
+// DuplicatePolicy is how ServerList.SetServers handles servers listed
+// more than once, as compared after resolution, so that "localhost:11211"
+// and "127.0.0.1:11211" are the same server.
+type DuplicatePolicy int
+
+const (
+	// DuplicatesWeight gives a server listed several times that much
+	// more weight. It is the default.
+	DuplicatesWeight DuplicatePolicy = iota
+	// DuplicatesDrop keeps only the first of a server's listings, so
+	// that each server is given equal weight.
+	DuplicatesDrop
+	// DuplicatesReject makes SetServers fail with ErrDuplicateServer,
+	// to catch a misconfigured server list.
+	DuplicatesReject
+)
+
+// staticAddr caches the Network() and String() values from any net.Addr,
+// along with the host name it was resolved from, if any.
 type staticAddr struct {
 	ntw, str string
+	host     string
 }
 
 func newStaticAddr(a net.Addr) net.Addr {
@@ -55,44 +103,121 @@ func newStaticAddr(a net.Addr) net.Addr {
 func (s *staticAddr) Network() string { return s.ntw }
 func (s *staticAddr) String() string  { return s.str }
 
+// resolveAddr resolves a server name to a static net.Addr. Names
+// containing a "/" are treated as unix socket paths.
+func resolveAddr(server string) (net.Addr, error) {
+	if strings.Contains(server, "/") {
+		addr, err := net.ResolveUnixAddr("unix", server)
+		if err != nil {
+			return nil, err
+		}
+		return newStaticAddr(addr), nil
+	}
+	tcpaddr, err := net.ResolveTCPAddr("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	addr := &staticAddr{ntw: tcpaddr.Network(), str: tcpaddr.String()}
+	addr.host, _, _ = net.SplitHostPort(server)
+	return addr, nil
+}
+
 // SetServers changes a ServerList's set of servers at runtime and is
 // safe for concurrent use by multiple goroutines.
 //
 // Each server is given equal weight. A server is given more weight
 // if it's listed multiple times.
 //
+// Servers containing a "/" are unix socket paths; all others are
+// host:port TCP addresses, with IPv6 literals in brackets, as in
+// "[::1]:11211".
+//
 // SetServers returns an error if any of the server names fail to
 // resolve. No attempt is made to connect to the server. If any error
 // is returned, no changes are made to the ServerList.
+//
+// Servers listed more than once are handled per SetDuplicatePolicy.
 func (ss *ServerList) SetServers(servers ...string) error {
-	naddr := make([]net.Addr, len(servers))
-	for i, server := range servers {
-		if strings.Contains(server, "/") {
-			addr, err := net.ResolveUnixAddr("unix", server)
-			if err != nil {
-				return err
-			}
-			naddr[i] = newStaticAddr(addr)
-		} else {
-			tcpaddr, err := net.ResolveTCPAddr("tcp", server)
-			if err != nil {
-				return err
+	ss.mu.RLock()
+	dups := ss.dups
+	ss.mu.RUnlock()
+	naddr := make([]net.Addr, 0, len(servers))
+	seen := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		addr, err := resolveAddr(server)
+		if err != nil {
+			return err
+		}
+		if seen[addr.String()] {
+			switch dups {
+			case DuplicatesDrop:
+				continue
+			case DuplicatesReject:
+				return fmt.Errorf("%w: %s resolves to %s", ErrDuplicateServer, server, addr)
 			}
-			naddr[i] = newStaticAddr(tcpaddr)
 		}
+		seen[addr.String()] = true
+		naddr = append(naddr, addr)
 	}
 
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 	ss.addrs = naddr
+	ss.version++
 	return nil
 }
 
-// Each iterates over each server calling the given function
-func (ss *ServerList) Each(f func(net.Addr) error) error {
+func (ss *ServerList) selectionVersion() (uint64, bool) {
 	ss.mu.RLock()
 	defer ss.mu.RUnlock()
-	for _, a := range ss.addrs {
+	return ss.version, true
+}
+
+// SetDuplicatePolicy sets how later calls to SetServers handle servers
+// listed more than once. It is safe for concurrent use by multiple
+// goroutines, and leaves the current servers as they are.
+func (ss *ServerList) SetDuplicatePolicy(p DuplicatePolicy) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.dups = p
+}
+
+// SetBinaryServers marks the given servers as speaking the binary
+// protocol, replacing any earlier marks, which makes the ServerList a
+// ProtocolSelector. It is safe for concurrent use by multiple
+// goroutines. If any of the server names fail to resolve, no changes
+// are made.
+func (ss *ServerList) SetBinaryServers(servers ...string) error {
+	binary := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		addr, err := resolveAddr(server)
+		if err != nil {
+			return err
+		}
+		binary[addr.String()] = true
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.binary = binary
+	return nil
+}
+
+// IsBinary reports whether addr was marked by SetBinaryServers
+func (ss *ServerList) IsBinary(addr net.Addr) bool {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.binary[addr.String()]
+}
+
+// Each iterates over each server calling the given function. It iterates
+// over the servers set when it is called, without holding the list's
+// lock, so f may call the list's other methods, including SetServers.
+func (ss *ServerList) Each(f func(net.Addr) error) error {
+	ss.mu.RLock()
+	addrs := ss.addrs
+	ss.mu.RUnlock()
+	for _, a := range addrs {
 		if err := f(a); nil != err {
 			return err
 		}
@@ -117,13 +242,221 @@ func (ss *ServerList) PickServer(key string) (net.Addr, error) {
 	if len(ss.addrs) == 0 {
 		return nil, ErrNoServers
 	}
+	return ss.addrs[ss.pick(key)], nil
+}
+
+// pick returns the index of key's server in ss.addrs, which must not be
+// empty. ss.mu must be held.
+func (ss *ServerList) pick(key string) int {
 	if len(ss.addrs) == 1 {
-		return ss.addrs[0], nil
+		return 0
 	}
 	bufp := keyBufPool.Get().(*[]byte)
 	n := copy(*bufp, key)
 	cs := crc32.ChecksumIEEE((*bufp)[:n])
 	keyBufPool.Put(bufp)
 
-	return ss.addrs[cs%uint32(len(ss.addrs))], nil
+	return int(cs % uint32(len(ss.addrs)))
+}
+
+// ReplicaSelector is a ServerSelector that can also place a key on
+// several servers, for keys replicated for availability.
+type ReplicaSelector interface {
+	ServerSelector
+	// PickReplicas returns the distinct servers holding key's replicas,
+	// in order of preference, which is usually led by the server
+	// PickServer returns for key.
+	PickReplicas(key string) ([]net.Addr, error)
+}
+
+// ReplicaList is a ServerList that is also a ReplicaSelector. The
+// replicas of a key are the server PickServer returns followed by the
+// next distinct servers of the list, wrapping around. Its zero value is
+// usable, with a single replica per key until SetReplicas is called.
+type ReplicaList struct {
+	ServerList
+	replicas int // guarded by ServerList.mu
+}
+
+// SetReplicas changes the number of replicas of each key at runtime and
+// is safe for concurrent use by multiple goroutines. If there are fewer
+// distinct servers, each key is replicated to all of them.
+func (rl *ReplicaList) SetReplicas(n int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.replicas = n
+}
+
+// PickReplicas returns the servers holding key's replicas
+func (rl *ReplicaList) PickReplicas(key string) ([]net.Addr, error) {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	if len(rl.addrs) == 0 {
+		return nil, ErrNoServers
+	}
+	first := rl.pick(key)
+	addrs := []net.Addr{rl.addrs[first]}
+	for i := 1; i < len(rl.addrs) && len(addrs) < rl.replicas; i++ {
+		addr := rl.addrs[(first+i)%len(rl.addrs)]
+		if !containsAddr(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func containsAddr(addrs []net.Addr, addr net.Addr) bool {
+	for _, a := range addrs {
+		if a.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// SingleEndpoint is a ServerSelector for a single proxy endpoint, such as
+// mcrouter or twemproxy, that does its own key distribution. PickServer
+// always returns the proxy address regardless of the key, and GetMulti
+// sends all keys to the proxy in one request. Its zero value is usable
+// once SetServer has been called.
+type SingleEndpoint struct {
+	mu      sync.RWMutex
+	addr    net.Addr
+	version uint64 // bumped by SetServer
+}
+
+// SetServer changes the proxy address at runtime and is safe for
+// concurrent use by multiple goroutines. If the address fails to
+// resolve, no changes are made.
+func (se *SingleEndpoint) SetServer(server string) error {
+	addr, err := resolveAddr(server)
+	if err != nil {
+		return err
+	}
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.addr = addr
+	se.version++
+	return nil
+}
+
+func (se *SingleEndpoint) selectionVersion() (uint64, bool) {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+	return se.version, true
+}
+
+// PickServer returns the proxy address for every key
+func (se *SingleEndpoint) PickServer(key string) (net.Addr, error) {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+	if se.addr == nil {
+		return nil, ErrNoServers
+	}
+	return se.addr, nil
+}
+
+// Each calls the given function with the proxy address
+func (se *SingleEndpoint) Each(f func(net.Addr) error) error {
+	addr, err := se.PickServer("")
+	if err != nil {
+		return nil
+	}
+	return f(addr)
+}
+
+// PrefixSelector is a ServerSelector that places keys starting with a
+// configured prefix, such as a tenant's "tenant:", on a dedicated list of
+// servers, and all other keys on a default list. This isolates a
+// tenant's keys from the rest of the cache. If several prefixes match a
+// key, the longest wins. Its zero value is usable.
+type PrefixSelector struct {
+	mu       sync.RWMutex
+	prefixes []prefixServers // sorted longest prefix first
+	def      ServerList
+	version  uint64 // bumped by SetPrefix
+}
+
+type prefixServers struct {
+	prefix string
+	ss     *ServerList
+}
+
+// SetPrefix sets the servers used for keys starting with prefix, which
+// are hashed over the servers as by ServerList. Calling SetPrefix with no
+// servers removes the prefix. If any server fails to resolve, no changes
+// are made.
+func (ps *PrefixSelector) SetPrefix(prefix string, servers ...string) error {
+	ss := new(ServerList)
+	if err := ss.SetServers(servers...); err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	prefixes := make([]prefixServers, 0, len(ps.prefixes)+1)
+	for _, p := range ps.prefixes {
+		if p.prefix != prefix {
+			prefixes = append(prefixes, p)
+		}
+	}
+	if len(servers) > 0 {
+		prefixes = append(prefixes, prefixServers{prefix: prefix, ss: ss})
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return len(prefixes[i].prefix) > len(prefixes[j].prefix)
+	})
+	ps.prefixes = prefixes
+	ps.version++
+	return nil
+}
+
+// SetDefault sets the servers used for keys matching no prefix.
+func (ps *PrefixSelector) SetDefault(servers ...string) error {
+	return ps.def.SetServers(servers...)
+}
+
+// selectionVersion changes with SetPrefix and with SetDefault, as both
+// versions only grow
+func (ps *PrefixSelector) selectionVersion() (uint64, bool) {
+	def, _ := ps.def.selectionVersion()
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.version + def, true
+}
+
+// PickServer returns a server from the list of the longest prefix of
+// key, or from the default list.
+func (ps *PrefixSelector) PickServer(key string) (net.Addr, error) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, p := range ps.prefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			return p.ss.PickServer(key)
+		}
+	}
+	return ps.def.PickServer(key)
+}
+
+// Each iterates over each distinct server of the default and prefix lists
+func (ps *PrefixSelector) Each(f func(net.Addr) error) error {
+	ps.mu.RLock()
+	prefixes := ps.prefixes
+	ps.mu.RUnlock()
+	seen := make(map[string]bool)
+	g := func(a net.Addr) error {
+		if seen[a.String()] {
+			return nil
+		}
+		seen[a.String()] = true
+		return f(a)
+	}
+	if err := ps.def.Each(g); err != nil {
+		return err
+	}
+	for _, p := range prefixes {
+		if err := p.ss.Each(g); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -17,8 +17,12 @@ limitations under the License.
 package memcache
 
 import (
-	"github.com/stretchr/testify/assert"
+	"errors"
+	"fmt"
+	"net"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func BenchmarkPickServer(b *testing.B) {
@@ -40,3 +44,164 @@ func benchPickServer(b *testing.B, servers ...string) {
 		}
 	}
 }
+
+func TestSingleEndpoint(t *testing.T) {
+	var se SingleEndpoint
+	_, err := se.PickServer("foo")
+	assert.Equal(t, ErrNoServers, err)
+
+	assert.NoError(t, se.SetServer("127.0.0.1:1234"))
+	for _, key := range []string{"foo", "bar", "baz"} {
+		addr, err := se.PickServer(key)
+		assert.NoError(t, err)
+		assert.Equal(t, "127.0.0.1:1234", addr.String())
+	}
+
+	var seen []string
+	assert.NoError(t, se.Each(func(addr net.Addr) error {
+		seen = append(seen, addr.String())
+		return nil
+	}))
+	assert.Equal(t, []string{"127.0.0.1:1234"}, seen)
+}
+
+func TestSetServersIPv6(t *testing.T) {
+	var ss ServerList
+	assert.NoError(t, ss.SetServers("[::1]:11211", "127.0.0.1:11211", "/tmp/memcached.sock"))
+	var addrs []net.Addr
+	assert.NoError(t, ss.Each(func(addr net.Addr) error {
+		addrs = append(addrs, addr)
+		return nil
+	}))
+	assert.Equal(t, "tcp", addrs[0].Network())
+	assert.Equal(t, "[::1]:11211", addrs[0].String())
+	assert.Equal(t, "tcp", addrs[1].Network())
+	assert.Equal(t, "unix", addrs[2].Network())
+}
+
+func TestDialIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("skipping test; no IPv6 loopback: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		buf := make([]byte, 64)
+		nc.Read(buf)
+		nc.Write([]byte("END\r\n"))
+	}()
+	c := New(ln.Addr().String())
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestClientServers(t *testing.T) {
+	var ss ServerList
+	assert.NoError(t, ss.SetServers("127.0.0.1:1234", "127.0.0.1:1235"))
+	c := NewFromSelector(&ss)
+	assert.Equal(t, []string{"127.0.0.1:1234", "127.0.0.1:1235"}, c.Servers())
+
+	assert.NoError(t, ss.SetServers("127.0.0.1:1236"))
+	assert.Equal(t, []string{"127.0.0.1:1236"}, c.Servers())
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	var ss ServerList
+	c := NewFromSelector(&ss)
+	assert.NoError(t, ss.SetServers("127.0.0.1:1234", "127.0.0.1:1235", "127.0.0.1:1234"))
+	assert.Equal(t, []string{"127.0.0.1:1234", "127.0.0.1:1235", "127.0.0.1:1234"}, c.Servers(), "weighted")
+
+	ss.SetDuplicatePolicy(DuplicatesDrop)
+	assert.NoError(t, ss.SetServers("127.0.0.1:1234", "127.0.0.1:1235", "127.0.0.1:1234"))
+	assert.Equal(t, []string{"127.0.0.1:1234", "127.0.0.1:1235"}, c.Servers(), "deduped")
+
+	ss.SetDuplicatePolicy(DuplicatesReject)
+	err := ss.SetServers("127.0.0.1:1236", "127.0.0.1:1234", "127.0.0.1:1236")
+	assert.True(t, errors.Is(err, ErrDuplicateServer))
+	assert.Equal(t, []string{"127.0.0.1:1234", "127.0.0.1:1235"}, c.Servers(), "unchanged")
+}
+
+func TestDistribution(t *testing.T) {
+	var ss ServerList
+	assert.NoError(t, ss.SetServers("127.0.0.1:1234", "127.0.0.1:1235"))
+	c := NewFromSelector(&ss)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	dist := c.Distribution(keys)
+	assert.Len(t, dist, 2)
+	total := 0
+	for addr, n := range dist {
+		want, err := ss.PickServer(keyFor(t, &ss, addr.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, want, addr)
+		assert.True(t, n > 0)
+		total += n
+	}
+	assert.Equal(t, len(keys), total)
+
+	assert.NoError(t, ss.SetServers())
+	assert.Empty(t, c.Distribution(keys))
+}
+
+func TestPrefixSelector(t *testing.T) {
+	var ps PrefixSelector
+	_, err := ps.PickServer("foo")
+	assert.Equal(t, ErrNoServers, err)
+
+	assert.NoError(t, ps.SetDefault("127.0.0.1:1000", "127.0.0.1:1001"))
+	assert.NoError(t, ps.SetPrefix("acme:", "127.0.0.1:2000"))
+	assert.NoError(t, ps.SetPrefix("acme:big:", "127.0.0.1:3000", "127.0.0.1:3001"))
+
+	pick := func(key string) string {
+		addr, err := ps.PickServer(key)
+		assert.NoError(t, err)
+		return addr.String()
+	}
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "127.0.0.1:2000", pick(fmt.Sprintf("acme:%d", i)))
+		assert.Contains(t, []string{"127.0.0.1:3000", "127.0.0.1:3001"}, pick(fmt.Sprintf("acme:big:%d", i)))
+		assert.Contains(t, []string{"127.0.0.1:1000", "127.0.0.1:1001"}, pick(fmt.Sprintf("other:%d", i)))
+	}
+
+	var seen []string
+	assert.NoError(t, ps.Each(func(addr net.Addr) error {
+		seen = append(seen, addr.String())
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"127.0.0.1:1000", "127.0.0.1:1001", "127.0.0.1:2000", "127.0.0.1:3000", "127.0.0.1:3001"}, seen)
+
+	// removing a prefix falls back to the default list
+	assert.NoError(t, ps.SetPrefix("acme:"))
+	assert.Contains(t, []string{"127.0.0.1:1000", "127.0.0.1:1001"}, pick("acme:1"))
+}
+
+func TestServerListEachReentrant(t *testing.T) {
+	var ss ServerList
+	assert.NoError(t, ss.SetServers("127.0.0.1:11211", "127.0.0.1:11212"))
+	var got []string
+	err := ss.Each(func(addr net.Addr) error {
+		// the list's methods can be called from f
+		_, err := ss.PickServer("foo")
+		assert.NoError(t, err)
+		got = append(got, addr.String())
+		return ss.SetServers("127.0.0.1:11213")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:11211", "127.0.0.1:11212"}, got)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = ss.Each(func(net.Addr) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+}
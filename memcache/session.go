@@ -0,0 +1,121 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+// Session runs a sequence of operations over connections that stay
+// pinned to it, one per server, so that dependent operations on the same
+// key are always sent in order over the same connection. A Session is
+// not safe for concurrent use. Close must be called to return its
+// connections to the client's pool.
+type Session struct {
+	c     *Client
+	conns map[string]*conn
+}
+
+// Session returns a new Session using the client's servers and pool.
+func (c *Client) Session() *Session {
+	return &Session{c: c, conns: make(map[string]*conn)}
+}
+
+// do runs fn on the session's connection to the server for key. A
+// connection that fails with a non-resumable error is closed and
+// unpinned; the next operation dials a new one.
+func (s *Session) do(key string, fn func(*conn) error) error {
+	if err := s.c.ValidateKey(key); err != nil {
+		return err
+	}
+	addr, err := s.c.selector.PickServer(key)
+	if err != nil {
+		return err
+	}
+	cn, ok := s.conns[addr.String()]
+	if ok {
+		err = cn.extendDeadline()
+	} else {
+		cn, err = s.c.getConn(addr)
+	}
+	if err != nil {
+		if ok {
+			cn.close()
+		}
+		delete(s.conns, addr.String())
+		return err
+	}
+	s.conns[addr.String()] = cn
+	err = fn(cn)
+	if cn.broken || err != nil && !s.c.resumableError(err) {
+		cn.close()
+		delete(s.conns, addr.String())
+	}
+	return err
+}
+
+// Get is like Client.Get, but runs on the session's connection.
+func (s *Session) Get(key string) (item *Item, err error) {
+	s.c.accessKey("get", key)
+	err = s.do(key, func(cn *conn) error {
+		return s.c.getKeys(cn.rw, s.c.binaryFor(cn.addr), nil, []string{key}, func(it *Item) error {
+			item = it
+			return nil
+		})
+	})
+	if err == nil && item == nil {
+		err = ErrCacheMiss
+	}
+	return item, err
+}
+
+// Set is like Client.Set, but runs on the session's connection.
+func (s *Session) Set(item *Item) error {
+	s.c.accessKey("set", item.Key)
+	if err := s.c.validateItem(item); err != nil {
+		return err
+	}
+	return s.do(item.Key, func(cn *conn) error {
+		if err := s.c.checkItemSize(cn.addr, item); err != nil {
+			return err
+		}
+		_, err := s.c.set(cn, item)
+		return err
+	})
+}
+
+// CompareAndSwap is like Client.CompareAndSwap, but runs on the
+// session's connection.
+func (s *Session) CompareAndSwap(item *Item) error {
+	s.c.accessKey("cas", item.Key)
+	if err := s.c.validateItem(item); err != nil {
+		return err
+	}
+	return s.do(item.Key, func(cn *conn) error {
+		if err := s.c.checkItemSize(cn.addr, item); err != nil {
+			return err
+		}
+		_, err := s.c.cas(cn, item)
+		return err
+	})
+}
+
+// Close returns the session's connections to the client's pool. The
+// session must not be used afterwards.
+func (s *Session) Close() error {
+	for addr, cn := range s.conns {
+		cn.release()
+		delete(s.conns, addr)
+	}
+	return nil
+}
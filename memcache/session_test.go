@@ -0,0 +1,45 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	addr, _ := memoryServer(t, -1)
+	c := New(addr)
+	s := c.Session()
+
+	assert.NoError(t, s.Set(&Item{Key: "foo", Value: []byte("bar")}))
+	pinned := s.conns[addr]
+	assert.NotNil(t, pinned)
+	assert.Empty(t, c.freeconn[addr])
+
+	it, err := s.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), it.Value)
+	_, err = s.Get("missing")
+	assert.Equal(t, ErrCacheMiss, err)
+	// every operation ran on the same connection
+	assert.True(t, pinned == s.conns[addr])
+
+	assert.NoError(t, s.Close())
+	assert.Equal(t, []*conn{pinned}, c.freeconn[addr])
+}
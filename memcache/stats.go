@@ -0,0 +1,467 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var statPrefix = []byte("STAT ")
+
+// Stats returns the general statistics of every server, as reported by
+// the "stats" command, keyed by server and then by statistic name. If
+// some servers fail, the statistics of the others are returned along
+// with a ServerErrors.
+func (c *Client) Stats() (map[net.Addr]map[string]string, error) {
+	return c.statsEach("")
+}
+
+// statsEach runs a stats command with the given arguments on every
+// server in parallel
+func (c *Client) statsEach(args string) (map[net.Addr]map[string]string, error) {
+	var mu sync.Mutex
+	stats := make(map[net.Addr]map[string]string)
+	err := c.eachParallel(func(addr net.Addr) error {
+		s, err := c.statsFromAddr(addr, args)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		stats[addr] = s
+		mu.Unlock()
+		return nil
+	})
+	if err == ErrNoServers {
+		return nil, err
+	}
+	return stats, err
+}
+
+// statsFromAddr runs a stats command with the given arguments, such as
+// "settings", on addr. ErrNoStats is returned if the server reports
+// none.
+func (c *Client) statsFromAddr(addr net.Addr, args string) (map[string]string, error) {
+	if c.binaryFor(addr) {
+		return nil, ErrUnsupported
+	}
+	var stats map[string]string
+	err := c.withAddrRw(addr, func(rw *bufio.ReadWriter) (err error) {
+		stats, err = c.statsFromRw(rw, args)
+		return err
+	})
+	return stats, err
+}
+
+// statsFromRw is like statsFromAddr, but runs the command on rw
+func (c *Client) statsFromRw(rw *bufio.ReadWriter, args string) (map[string]string, error) {
+	cmd := statsCommand(args)
+	if _, err := fmt.Fprintf(rw, "%s\r\n", cmd); err != nil {
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+	stats, err := c.readStats(rw.Reader, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 {
+		return nil, ErrNoStats
+	}
+	return stats, nil
+}
+
+// statsCommand returns the stats command with the given arguments
+func statsCommand(args string) string {
+	if args == "" {
+		return "stats"
+	}
+	return "stats " + args
+}
+
+// readStats reads the response to the stats command cmd from r
+func (c *Client) readStats(r *bufio.Reader, cmd string) (map[string]string, error) {
+	stats := make(map[string]string)
+	for {
+		line, err := c.readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(line, resultEnd) {
+			return stats, nil
+		}
+		if !bytes.HasPrefix(line, statPrefix) || !bytes.HasSuffix(line, crlf) {
+			return nil, unexpectedResponse(cmd, line)
+		}
+		f := strings.SplitN(string(line[len(statPrefix):len(line)-2]), " ", 2)
+		if len(f) != 2 {
+			return nil, unexpectedResponse(cmd, line)
+		}
+		stats[f[0]] = f[1]
+	}
+}
+
+// StatsBundle is like calling Stats with each of args, such as "",
+// "items" and "slabs", but pipelines the stats commands on one
+// connection per server, saving a round trip per command. The
+// statistics are keyed by server, then by argument, and then by
+// statistic name; an argument for which a server reports nothing maps
+// to an empty map. If some servers fail, the statistics of the others
+// are returned along with a ServerErrors.
+func (c *Client) StatsBundle(args ...string) (map[net.Addr]map[string]map[string]string, error) {
+	var mu sync.Mutex
+	bundles := make(map[net.Addr]map[string]map[string]string)
+	err := c.eachParallel(func(addr net.Addr) error {
+		if c.binaryFor(addr) {
+			return ErrUnsupported
+		}
+		bundle := make(map[string]map[string]string, len(args))
+		err := c.withAddrRw(addr, func(rw *bufio.ReadWriter) error {
+			for _, arg := range args {
+				if _, err := fmt.Fprintf(rw, "%s\r\n", statsCommand(arg)); err != nil {
+					return err
+				}
+			}
+			if err := rw.Flush(); err != nil {
+				return err
+			}
+			for _, arg := range args {
+				stats, err := c.readStats(rw.Reader, statsCommand(arg))
+				if err != nil {
+					return err
+				}
+				bundle[arg] = stats
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		bundles[addr] = bundle
+		mu.Unlock()
+		return nil
+	})
+	if err == ErrNoServers {
+		return nil, err
+	}
+	return bundles, err
+}
+
+// StatsSummary holds the most commonly used general statistics of a
+// server, parsed from those returned by Stats.
+type StatsSummary struct {
+	// CurrItems is the number of items stored.
+	CurrItems uint64
+	// Bytes is the number of bytes used to store items.
+	Bytes uint64
+	// GetHits and GetMisses are the numbers of keys requested that were
+	// found and that weren't.
+	GetHits, GetMisses uint64
+	// Evictions is the number of valid items removed to free memory.
+	Evictions uint64
+	// Uptime is the time since the server started.
+	Uptime time.Duration
+	// HitRatio is GetHits over all the keys requested, or 0 if none
+	// were.
+	HitRatio float64
+}
+
+// StatsSummary returns the StatsSummary of every server. If some
+// servers fail, or report statistics that can't be parsed, the
+// summaries of the others are returned along with a ServerErrors.
+func (c *Client) StatsSummary() (map[net.Addr]StatsSummary, error) {
+	var mu sync.Mutex
+	summaries := make(map[net.Addr]StatsSummary)
+	err := c.eachParallel(func(addr net.Addr) error {
+		s, err := c.statsFromAddr(addr, "")
+		if err != nil {
+			return err
+		}
+		sum, err := parseStatsSummary(s)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		summaries[addr] = sum
+		mu.Unlock()
+		return nil
+	})
+	if err == ErrNoServers {
+		return nil, err
+	}
+	return summaries, err
+}
+
+func parseStatsSummary(stats map[string]string) (StatsSummary, error) {
+	var sum StatsSummary
+	var uptime uint64
+	for _, f := range []struct {
+		name string
+		v    *uint64
+	}{
+		{"curr_items", &sum.CurrItems},
+		{"bytes", &sum.Bytes},
+		{"get_hits", &sum.GetHits},
+		{"get_misses", &sum.GetMisses},
+		{"evictions", &sum.Evictions},
+		{"uptime", &uptime},
+	} {
+		n, err := strconv.ParseUint(stats[f.name], 10, 64)
+		if err != nil {
+			return StatsSummary{}, fmt.Errorf("memcache: bad %q statistic: %q", f.name, stats[f.name])
+		}
+		*f.v = n
+	}
+	sum.Uptime = time.Duration(uptime) * time.Second
+	if gets := sum.GetHits + sum.GetMisses; gets > 0 {
+		sum.HitRatio = float64(sum.GetHits) / float64(gets)
+	}
+	return sum, nil
+}
+
+// StatsSettings returns the runtime settings of every server, as
+// reported by the "stats settings" command, keyed by server and then by
+// setting name, such as "maxbytes". If some servers fail, the settings
+// of the others are returned along with a ServerErrors.
+func (c *Client) StatsSettings() (map[net.Addr]map[string]string, error) {
+	return c.statsEach("settings")
+}
+
+// ServerSettings holds the well-known numeric settings of a server,
+// parsed from those returned by StatsSettings.
+type ServerSettings struct {
+	// MaxBytes is the memory limit for items, set with -m.
+	MaxBytes int64
+	// MaxConns is the limit of simultaneous connections, set with -c.
+	MaxConns int
+	// ItemSizeMax is the maximum size of an item, set with -I.
+	ItemSizeMax int
+	// Threads is the number of worker threads, set with -t.
+	Threads int
+}
+
+// Settings returns the ServerSettings of every server, e.g. to validate
+// a deployment's configuration. If some servers fail, or report
+// settings that can't be parsed, the settings of the others are
+// returned along with a ServerErrors.
+func (c *Client) Settings() (map[net.Addr]ServerSettings, error) {
+	var mu sync.Mutex
+	settings := make(map[net.Addr]ServerSettings)
+	err := c.eachParallel(func(addr net.Addr) error {
+		s, err := c.statsFromAddr(addr, "settings")
+		if err != nil {
+			return err
+		}
+		ss, err := parseServerSettings(s)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		settings[addr] = ss
+		mu.Unlock()
+		return nil
+	})
+	if err == ErrNoServers {
+		return nil, err
+	}
+	return settings, err
+}
+
+func parseServerSettings(stats map[string]string) (ServerSettings, error) {
+	var ss ServerSettings
+	var err error
+	if ss.MaxBytes, err = strconv.ParseInt(stats["maxbytes"], 10, 64); err != nil {
+		return ServerSettings{}, fmt.Errorf("memcache: bad %q setting: %q", "maxbytes", stats["maxbytes"])
+	}
+	for _, f := range []struct {
+		name string
+		v    *int
+	}{
+		{"maxconns", &ss.MaxConns},
+		{"item_size_max", &ss.ItemSizeMax},
+		{"num_threads", &ss.Threads},
+	} {
+		if *f.v, err = strconv.Atoi(stats[f.name]); err != nil {
+			return ServerSettings{}, fmt.Errorf("memcache: bad %q setting: %q", f.name, stats[f.name])
+		}
+	}
+	return ss, nil
+}
+
+// evictionSnapshot is a server's eviction count at a given uptime
+type evictionSnapshot struct {
+	evictions, uptime uint64
+}
+
+// EvictionPressure returns the rate of evictions per second of every
+// server, a sign of memory pressure, e.g. to shorten TTLs or stop
+// writing when it is high. The rate is computed from the server's
+// "evictions" and "uptime" statistics, between the previous call and
+// this one; for the first call, and after a server restart, it is the
+// average since the server started. If some servers fail, the rates of
+// the others are returned along with a ServerErrors.
+func (c *Client) EvictionPressure() (map[net.Addr]float64, error) {
+	stats, err := c.Stats()
+	if stats == nil {
+		return nil, err
+	}
+	rates := make(map[net.Addr]float64, len(stats))
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.evictions == nil {
+		c.evictions = make(map[string]evictionSnapshot)
+	}
+	for addr, s := range stats {
+		var snap evictionSnapshot
+		var perr error
+		if snap.evictions, perr = strconv.ParseUint(s["evictions"], 10, 64); perr != nil {
+			continue
+		}
+		if snap.uptime, perr = strconv.ParseUint(s["uptime"], 10, 64); perr != nil {
+			continue
+		}
+		prev, ok := c.evictions[addr.String()]
+		if !ok || snap.uptime < prev.uptime || snap.evictions < prev.evictions {
+			prev = evictionSnapshot{}
+		}
+		if snap.uptime == prev.uptime {
+			// called again within a second of the server's clock
+			rates[addr] = 0
+			continue
+		}
+		rates[addr] = float64(snap.evictions-prev.evictions) / float64(snap.uptime-prev.uptime)
+		c.evictions[addr.String()] = snap
+	}
+	return rates, err
+}
+
+// ConnInfo is a server's view of one of its connections, as reported by
+// the "stats conns" command.
+type ConnInfo struct {
+	// FD is the connection's file descriptor on the server.
+	FD int
+	// Addr is the address of the connection's peer, such as a client's
+	// "tcp:10.0.0.1:52314", or the address listened on for a listening
+	// socket.
+	Addr string
+	// ListenAddr is the address the connection was accepted on, if any.
+	ListenAddr string
+	// State is the connection's state, such as "conn_parse_cmd",
+	// "conn_waiting" or "conn_listening".
+	State string
+	// SecsSinceLastCmd is the number of seconds since the connection's
+	// last command.
+	SecsSinceLastCmd int
+}
+
+// StatsConns returns every server's connections, in order of file
+// descriptor, which complements PoolStats with the servers' view, e.g.
+// to tell whether connections leak in clients or in servers. If some
+// servers fail, the connections of the others are returned along with a
+// ServerErrors.
+func (c *Client) StatsConns() (map[net.Addr][]ConnInfo, error) {
+	stats, err := c.statsEach("conns")
+	if stats == nil {
+		return nil, err
+	}
+	conns := make(map[net.Addr][]ConnInfo, len(stats))
+	for addr, s := range stats {
+		conns[addr] = parseConnInfos(s)
+	}
+	return conns, err
+}
+
+// parseConnInfos groups "stats conns" statistics, named "<fd>:<field>",
+// by file descriptor. Unknown fields are ignored.
+func parseConnInfos(stats map[string]string) []ConnInfo {
+	byFD := make(map[int]*ConnInfo)
+	for name, value := range stats {
+		i := strings.IndexByte(name, ':')
+		if i < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(name[:i])
+		if err != nil {
+			continue
+		}
+		ci, ok := byFD[fd]
+		if !ok {
+			ci = &ConnInfo{FD: fd}
+			byFD[fd] = ci
+		}
+		switch name[i+1:] {
+		case "addr":
+			ci.Addr = value
+		case "listen_addr":
+			ci.ListenAddr = value
+		case "state":
+			ci.State = value
+		case "secs_since_last_cmd":
+			ci.SecsSinceLastCmd, _ = strconv.Atoi(value)
+		}
+	}
+	conns := make([]ConnInfo, 0, len(byFD))
+	for _, ci := range byFD {
+		conns = append(conns, *ci)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].FD < conns[j].FD })
+	return conns
+}
+
+// StatsSlabs returns the statistics of every server's slab classes, as
+// reported by the "stats slabs" command, keyed by server, then by slab
+// class ID, such as "1", and then by statistic name, such as
+// "chunk_size". Statistics of the server's slabs as a whole, such as
+// "active_slabs", are keyed by the empty class "". If some servers fail,
+// the statistics of the others are returned along with a ServerErrors.
+func (c *Client) StatsSlabs() (map[net.Addr]map[string]map[string]string, error) {
+	stats, err := c.statsEach("slabs")
+	if stats == nil {
+		return nil, err
+	}
+	slabs := make(map[net.Addr]map[string]map[string]string, len(stats))
+	for addr, s := range stats {
+		slabs[addr] = groupSlabStats(s)
+	}
+	return slabs, err
+}
+
+// groupSlabStats groups "stats slabs" statistics, named
+// "<class>:<name>" or just "<name>", by slab class
+func groupSlabStats(stats map[string]string) map[string]map[string]string {
+	byClass := make(map[string]map[string]string)
+	for name, value := range stats {
+		var class string
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			class, name = name[:i], name[i+1:]
+		}
+		if byClass[class] == nil {
+			byClass[class] = make(map[string]string)
+		}
+		byClass[class][name] = value
+	}
+	return byClass
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		switch line {
+		case "stats":
+			fmt.Fprintf(rw, "STAT pid 42\r\nSTAT version 1.6.21\r\nSTAT rusage_user 0.5 extra\r\nEND\r\n")
+		case "stats settings":
+			fmt.Fprintf(rw, "END\r\n")
+		}
+	})
+	c := New(addr)
+	stats, err := c.Stats()
+	assert.NoError(t, err)
+	assert.Len(t, stats, 1)
+	for _, s := range stats {
+		assert.Equal(t, map[string]string{
+			"pid":         "42",
+			"version":     "1.6.21",
+			"rusage_user": "0.5 extra",
+		}, s)
+	}
+
+	for addr := range stats {
+		_, err = c.statsFromAddr(addr, "settings")
+		assert.Equal(t, ErrNoStats, err)
+	}
+}
+
+func TestEvictionPressure(t *testing.T) {
+	var n int32
+	snapshots := [][2]int{{100, 10}, {160, 20}, {160, 20}, {5, 1}}
+	c := New(fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if line == "stats" {
+			s := snapshots[atomic.AddInt32(&n, 1)-1]
+			fmt.Fprintf(rw, "STAT uptime %d\r\nSTAT evictions %d\r\nEND\r\n", s[1], s[0])
+		}
+	}))
+	want := []float64{
+		10, // since the server started
+		6,  // 60 evictions over 10s
+		0,  // no time elapsed
+		5,  // restarted
+	}
+	for _, w := range want {
+		rates, err := c.EvictionPressure()
+		assert.NoError(t, err)
+		assert.Len(t, rates, 1)
+		for _, r := range rates {
+			assert.Equal(t, w, r)
+		}
+	}
+}
+
+func TestStatsConns(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if line == "stats conns" {
+			fmt.Fprintf(rw, "STAT 26:addr tcp:127.0.0.1:52314\r\n"+
+				"STAT 26:listen_addr tcp:0.0.0.0:11211\r\n"+
+				"STAT 26:state conn_parse_cmd\r\n"+
+				"STAT 26:secs_since_last_cmd 3\r\n"+
+				"STAT 5:addr tcp:0.0.0.0:11211\r\n"+
+				"STAT 5:state conn_listening\r\n"+
+				"STAT 5:secs_since_last_cmd 120\r\n"+
+				"END\r\n")
+		}
+	})
+	c := New(addr)
+	conns, err := c.StatsConns()
+	assert.NoError(t, err)
+	assert.Len(t, conns, 1)
+	for _, ci := range conns {
+		assert.Equal(t, []ConnInfo{
+			{FD: 5, Addr: "tcp:0.0.0.0:11211", State: "conn_listening", SecsSinceLastCmd: 120},
+			{FD: 26, Addr: "tcp:127.0.0.1:52314", ListenAddr: "tcp:0.0.0.0:11211", State: "conn_parse_cmd", SecsSinceLastCmd: 3},
+		}, ci)
+	}
+}
+
+func TestStatsSlabs(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if line == "stats slabs" {
+			fmt.Fprintf(rw, "STAT 1:chunk_size 96\r\n"+
+				"STAT 1:used_chunks 10\r\n"+
+				"STAT 5:chunk_size 240\r\n"+
+				"STAT active_slabs 2\r\n"+
+				"STAT total_malloced 2097152\r\n"+
+				"END\r\n")
+		}
+	})
+	c := New(addr)
+	slabs, err := c.StatsSlabs()
+	assert.NoError(t, err)
+	assert.Len(t, slabs, 1)
+	for _, s := range slabs {
+		assert.Equal(t, map[string]map[string]string{
+			"1": {"chunk_size": "96", "used_chunks": "10"},
+			"5": {"chunk_size": "240"},
+			"":  {"active_slabs": "2", "total_malloced": "2097152"},
+		}, s)
+	}
+}
+
+func TestStatsSummary(t *testing.T) {
+	good := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "STAT uptime 3600\r\nSTAT curr_items 10\r\nSTAT bytes 2048\r\n"+
+			"STAT get_hits 30\r\nSTAT get_misses 10\r\nSTAT evictions 2\r\nEND\r\n")
+	})
+	bad := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "STAT uptime 3600\r\nEND\r\n")
+	})
+	c := New(good, bad)
+	summaries, err := c.StatsSummary()
+	var se ServerErrors
+	if assert.True(t, errors.As(err, &se), err) {
+		assert.Len(t, se, 1)
+	}
+	assert.Len(t, summaries, 1)
+	for _, sum := range summaries {
+		assert.Equal(t, StatsSummary{
+			CurrItems: 10,
+			Bytes:     2048,
+			GetHits:   30,
+			GetMisses: 10,
+			Evictions: 2,
+			Uptime:    time.Hour,
+			HitRatio:  0.75,
+		}, sum)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		if line == "stats settings" {
+			fmt.Fprintf(rw, "STAT maxbytes 67108864\r\nSTAT maxconns 1024\r\nSTAT tcpport 11211\r\n"+
+				"STAT num_threads 4\r\nSTAT item_size_max 1048576\r\nEND\r\n")
+		}
+	})
+	c := New(addr)
+	raw, err := c.StatsSettings()
+	assert.NoError(t, err)
+	for _, s := range raw {
+		assert.Equal(t, "11211", s["tcpport"])
+	}
+	settings, err := c.Settings()
+	assert.NoError(t, err)
+	assert.Len(t, settings, 1)
+	for _, ss := range settings {
+		assert.Equal(t, ServerSettings{
+			MaxBytes:    64 << 20,
+			MaxConns:    1024,
+			ItemSizeMax: 1 << 20,
+			Threads:     4,
+		}, ss)
+	}
+}
+
+func TestStatsBundle(t *testing.T) {
+	var lines []string
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		lines = append(lines, line)
+		switch line {
+		case "stats":
+			fmt.Fprintf(rw, "STAT pid 42\r\nEND\r\n")
+		case "stats slabs":
+			fmt.Fprintf(rw, "STAT 1:chunk_size 96\r\nSTAT active_slabs 1\r\nEND\r\n")
+		case "stats items":
+			fmt.Fprintf(rw, "END\r\n")
+		}
+	})
+	c := New(addr)
+	bundles, err := c.StatsBundle("", "slabs", "items")
+	assert.NoError(t, err)
+	assert.Len(t, bundles, 1)
+	for _, b := range bundles {
+		assert.Equal(t, map[string]map[string]string{
+			"":      {"pid": "42"},
+			"slabs": {"1:chunk_size": "96", "active_slabs": "1"},
+			"items": {},
+		}, b)
+	}
+	assert.Equal(t, []string{"stats", "stats slabs", "stats items"}, lines)
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsClient wraps nc, dialed to addr, in a TLS connection per TLSConfig,
+// verifying the server name TLSServerName returns, if set, and completes
+// the handshake within the client's timeout
+func (c *Client) tlsClient(nc net.Conn, addr net.Addr) (net.Conn, error) {
+	cfg := c.TLSConfig.Clone()
+	if c.TLSServerName != nil {
+		cfg.ServerName = c.TLSServerName(addr)
+	} else if cfg.ServerName == "" {
+		cfg.ServerName = serverHost(addr)
+	}
+	tc := tls.Client(nc, cfg)
+	if err := tc.SetDeadline(time.Now().Add(c.netTimeout())); err != nil {
+		return nil, err
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// serverHost returns the host that addr was configured with, such as
+// "cache.example.com" for a ServerList given "cache.example.com:11211",
+// rather than the IP address it resolved to. For addresses not resolved
+// by this package, the host of addr's string is returned.
+func serverHost(addr net.Addr) string {
+	if sa, ok := addr.(*staticAddr); ok && sa.host != "" {
+		return sa.host
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return host
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2014 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert returns a self-signed certificate valid for the given DNS
+// names or IP addresses, and a pool trusting it.
+func testCert(t *testing.T, names ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// tlsServer starts a fake server behind TLS on 127.0.0.1 presenting a
+// certificate valid for names, and returns its port and a pool trusting
+// the certificate.
+func tlsServer(t *testing.T, handle func(line string, rw *bufio.ReadWriter), names ...string) (string, *x509.CertPool) {
+	cert, roots := testCert(t, names...)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFake(nc, handle)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port, roots
+}
+
+func TestTLSServerName(t *testing.T) {
+	port, roots := tlsServer(t, func(line string, rw *bufio.ReadWriter) {
+		rw.WriteString("END\r\n")
+	}, "example.com", "127.0.0.1")
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	c := New(addr)
+	c.TLSConfig = &tls.Config{RootCAs: roots}
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err, "verifying the address")
+
+	var names []string
+	c = New(addr)
+	c.TLSConfig = &tls.Config{RootCAs: roots, ServerName: "ignored"}
+	c.TLSServerName = func(a net.Addr) string {
+		names = append(names, a.String())
+		return "example.com"
+	}
+	_, err = c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err, "verifying example.com")
+	assert.Equal(t, []string{addr}, names)
+	assert.Equal(t, "ignored", c.TLSConfig.ServerName, "config not modified")
+
+	c = New(addr)
+	c.TLSConfig = &tls.Config{RootCAs: roots, ServerName: "example.org"}
+	_, err = c.Get("foo")
+	var de *DialError
+	assert.True(t, errors.As(err, &de), "verifying example.org")
+}
+
+func TestTLSVerifiesConfiguredHost(t *testing.T) {
+	port, roots := tlsServer(t, func(line string, rw *bufio.ReadWriter) {
+		rw.WriteString("END\r\n")
+	}, "localhost")
+
+	c := New(net.JoinHostPort("localhost", port))
+	c.TLSConfig = &tls.Config{RootCAs: roots}
+	_, err := c.Get("foo")
+	assert.Equal(t, ErrCacheMiss, err, "verifying localhost, not 127.0.0.1")
+
+	c = New(net.JoinHostPort("127.0.0.1", port))
+	c.TLSConfig = &tls.Config{RootCAs: roots}
+	_, err = c.Get("foo")
+	var de *DialError
+	assert.True(t, errors.As(err, &de), "verifying 127.0.0.1")
+}
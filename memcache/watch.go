@@ -0,0 +1,153 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watch streams the logs of every server, as enabled by the "watch"
+// command of memcached 1.5.4 or later, to out until ctx is done. The
+// subscriptions name the log types, such as "fetchers", "mutations" or
+// "evictions"; if there are none, the server's default is used. Each
+// server is watched on a dedicated connection that is never pooled, and
+// lines from several servers are interleaved. Watch returns ctx.Err()
+// once ctx is done, or the first error of a server's connection, which
+// stops watching all servers. Close interrupts it like any operation in
+// progress.
+func (c *Client) Watch(ctx context.Context, subscriptions []string, out chan<- string) error {
+	if c.Binary {
+		return ErrUnsupported
+	}
+	seen := make(map[string]bool)
+	var addrs []net.Addr
+	_ = c.selector.Each(func(addr net.Addr) error {
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			addrs = append(addrs, addr)
+		}
+		return nil
+	})
+	if len(addrs) == 0 {
+		return ErrNoServers
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(addrs))
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr net.Addr) {
+			defer wg.Done()
+			errs <- c.watch(ctx, addr, subscriptions, out)
+		}(addr)
+	}
+	// the first error is ctx's if it is done, since only then does any
+	// watch stop before cancel is called
+	err := <-errs
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// watch streams the logs of addr to out until ctx is done
+func (c *Client) watch(ctx context.Context, addr net.Addr, subscriptions []string, out chan<- string) error {
+	if c.binaryFor(addr) {
+		return ErrUnsupported
+	}
+	nc, err := c.dial(addr)
+	if err != nil {
+		return err
+	}
+	// tracked so that Close interrupts the watch, though it never
+	// holds a pool slot
+	cn := &conn{nc: nc, addr: addr, c: c}
+	if err := c.trackInUse(cn); err != nil {
+		_ = nc.Close()
+		return err
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblocks the read in progress, if any
+			_ = nc.Close()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+		cn.close()
+	}()
+
+	if err := nc.SetDeadline(time.Now().Add(c.netTimeout())); err != nil {
+		return err
+	}
+	rw := bufio.NewReadWriter(bufio.NewReaderSize(nc, c.readBufferSize()), bufio.NewWriter(nc))
+	cmd := "watch"
+	if len(subscriptions) > 0 {
+		cmd += " " + strings.Join(subscriptions, " ")
+	}
+	if _, err := fmt.Fprintf(rw, "%s\r\n", cmd); err != nil {
+		return ctxErr(ctx, err)
+	}
+	if err := rw.Flush(); err != nil {
+		return ctxErr(ctx, err)
+	}
+	line, err := c.readLine(rw.Reader)
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+	if !bytes.Equal(line, resultOK) {
+		return unexpectedResponse("watch", line)
+	}
+	// logs arrive whenever the server has some, so there's no deadline
+	if err := nc.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return ctxErr(ctx, err)
+		}
+		select {
+		case out <- strings.TrimRight(line, "\r\n"):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ctxErr returns ctx.Err() if ctx is done, since err is then only the
+// result of aborting the I/O in progress, and err otherwise.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
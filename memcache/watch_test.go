@@ -0,0 +1,85 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	commands := make(chan string, 1)
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		commands <- line
+		fmt.Fprintf(rw, "OK\r\n")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(rw, "ts=%d gid=%d type=item_get key=foo\r\n", i, i)
+		}
+	})
+	c := New(addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan string)
+	done := make(chan error)
+	go func() { done <- c.Watch(ctx, []string{"fetchers", "mutations"}, out) }()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, fmt.Sprintf("ts=%d gid=%d type=item_get key=foo", i, i), <-out)
+	}
+	assert.Equal(t, "watch fetchers mutations", <-commands)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	// the watch connection is never pooled
+	assert.Empty(t, c.freeconn)
+}
+
+func TestWatchClose(t *testing.T) {
+	started := make(chan struct{})
+	stall := make(chan struct{})
+	defer close(stall)
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "OK\r\n")
+		rw.Flush()
+		close(started)
+		<-stall // no logs
+	})
+	c := New(addr)
+	done := make(chan error)
+	go func() { done <- c.Watch(context.Background(), nil, make(chan string)) }()
+	<-started
+	assert.NoError(t, c.Close())
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch wasn't interrupted by Close")
+	}
+	assert.Empty(t, c.inUse)
+}
+
+func TestWatchUnsupported(t *testing.T) {
+	addr := fakeServer(t, func(line string, rw *bufio.ReadWriter) {
+		fmt.Fprintf(rw, "ERROR\r\n")
+	})
+	err := New(addr).Watch(context.Background(), nil, make(chan string))
+	assert.True(t, errors.Is(err, ErrUnknownCommand), err)
+}